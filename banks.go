@@ -0,0 +1,40 @@
+package main
+
+// bankChar switches to the next tape bank when -banks is above 1
+const bankChar = '@'
+
+// banks holds every tape bank, bank 0 being the tape a program is run on.
+// Programs start on bank 0 and @ moves on to the next bank, wrapping around
+// after the last, keeping the pointer where it is. The other banks start
+// zeroed and keep their contents until resetBanks.
+var banks [][]uint32
+var activeBank int
+
+// resetBanks drops the contents of all banks but bank 0
+func resetBanks() {
+	banks = nil
+	activeBank = 0
+}
+
+// startBanks makes cells bank 0 and the active bank, allocating the other
+// banks if needed
+func startBanks(cells []uint32) {
+	if len(banks) != bankCount {
+		banks = make([][]uint32, bankCount)
+		for i := 1; i < bankCount; i++ {
+			banks[i] = make([]uint32, memorySize)
+		}
+	}
+	banks[0] = cells
+	activeBank = 0
+}
+
+// switchBank makes *cells refer to the given bank
+func switchBank(cells *[]uint32, bank int) {
+	if len(banks) == 0 {
+		return
+	}
+	banks[activeBank] = *cells
+	activeBank = bank
+	*cells = banks[bank]
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestBanks(t *testing.T) {
+	bankCount = 2
+	updateDummyChars()
+	defer resetFlags()
+	// Each bank keeps its own cells
+	checkLevels(t, "+++@++@.@.", "", "\x03\x02")
+	// The pointer stays where it is when switching
+	checkLevels(t, "+@>++@.<.@>.", "", "\x00\x01\x02")
+	// Switching past the last bank goes back to bank 0
+	checkLevels(t, "+@@.", "", "\x01")
+	// Loops and copies work on the active bank
+	checkLevels(t, "@+++[->++<]@>.@.", "", "\x00\x06")
+	checkLevels(t, "++[@+++@-]@.", "", "\x06")
+
+	// The tape a program is run on is bank 0, whichever bank it ends on
+	var _, cells, _, err = runCode(t, "+@++", "", unoptimized)
+	if err != nil || cells[0] != 1 {
+		t.Errorf("got %v with cell 0 at %d, want cell 0 at 1", err, cells[0])
+	}
+
+	// With a single bank @ is a comment
+	bankCount = 1
+	updateDummyChars()
+	checkLevels(t, "+@+.", "", "\x02")
+}
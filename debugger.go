@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/colorstring"
+)
+
+func printDebugHelp() {
+	fmt.Fprintln(diagnostics, "Debugger commands:")
+	colorstring.Fprintln(diagnostics, "[blue]step[default], [blue]s[default] - execute the next instruction")
+	if rewindSteps > 0 {
+		colorstring.Fprintln(diagnostics, "[blue]back[default], [blue]b[default] - undo the last step (output and input are not undone)")
+	}
+	colorstring.Fprintln(diagnostics, "[blue]continue[default], [blue]c[default] - run until the program ends")
+	colorstring.Fprintln(diagnostics, "[blue]match[default], [blue]m[default] - move to the matching bracket of the next instruction without executing anything")
+	colorstring.Fprintln(diagnostics, "[blue]dump[default] - display values of memory cells")
+	colorstring.Fprintln(diagnostics, "[blue]quit[default], [blue]q[default] - stop debugging")
+}
+
+func printUpcoming(vm *machine) {
+	var instruction = vm.instructions[vm.pc]
+	var location = ""
+	if line, column, ok := vm.program.Position(vm.pc); ok {
+		location = fmt.Sprintf(" at line %d, column %d", line, column)
+	}
+	colorstring.Fprintf(diagnostics, "[blue]%d[default] %s %d %d (cell %d = %d)%s\n", vm.pc, instructionNames[instruction.Type], instruction.Data, instruction.AuxData, *vm.cellptr, cellValue((*vm.cells)[*vm.cellptr]), location)
+}
+
+// rewindEntry holds what a debugger step can change, as it was before the step
+type rewindEntry struct {
+	pc       int
+	cellptr  int
+	cell     int
+	value    uint32
+	auxptr   int
+	auxValue uint32
+	bank     int
+}
+
+// record returns the state the next instruction of vm may change
+func record(vm *machine) rewindEntry {
+	var entry = rewindEntry{pc: vm.pc, cellptr: *vm.cellptr, cell: *vm.cellptr, auxptr: auxCellptr, bank: activeBank}
+	if instruction := vm.instructions[vm.pc]; instruction.Type == MUL_CPY {
+		entry.cell = wrapIndex(entry.cell+instruction.Data, len(*vm.cells))
+	}
+	entry.value = (*vm.cells)[entry.cell]
+	if len(auxCells) > 0 {
+		entry.auxValue = auxCells[auxCellptr]
+	}
+	return entry
+}
+
+// restore undoes a step recorded by record
+func restore(vm *machine, entry rewindEntry) {
+	if entry.bank != activeBank {
+		switchBank(vm.cells, entry.bank)
+	}
+	vm.pc = entry.pc
+	*vm.cellptr = entry.cellptr
+	(*vm.cells)[entry.cell] = entry.value
+	auxCellptr = entry.auxptr
+	if len(auxCells) > 0 {
+		auxCells[auxCellptr] = entry.auxValue
+	}
+}
+
+// breakpointError stops a program when -breakwhen triggers. It keeps the
+// machine so the REPL can carry on from there in the debugger.
+type breakpointError struct {
+	*VMError
+	vm *machine
+}
+
+func (e *breakpointError) Unwrap() error {
+	return e.VMError
+}
+
+// isBreakpoint reports whether err is a -breakwhen breakpoint, telling the
+// user about it so the debugger can carry on
+func isBreakpoint(err error) bool {
+	var breakpoint *breakpointError
+	if errors.As(err, &breakpoint) {
+		parseMessage("", err.Error(), Info)
+		return true
+	}
+	return false
+}
+
+// debug compiles code and lets the user step through it on the given tape
+func debug(cells *[]uint32, cellptr *int, code *string) error {
+	var program, err = Compile(*code, Options{OptPasses: optPasses, Level: optLevel, Size: sizeOptimization})
+	if err != nil {
+		return err
+	}
+
+	var vm = machine{program: program, instructions: program.Instructions, cells: cells, cellptr: cellptr}
+	if bankCount > 1 {
+		startBanks(*cells)
+		defer switchBank(cells, 0)
+	}
+	return debugMachine(&vm)
+}
+
+// debugMachine lets the user step through the rest of vm's program
+func debugMachine(vm *machine) error {
+	var cells, cellptr = vm.cells, vm.cellptr
+	var err error
+	// The last -rewind steps, oldest first
+	var history = make([]rewindEntry, 0, rewindSteps)
+	var remember = func() {
+		if rewindSteps == 0 {
+			return
+		}
+		if len(history) == rewindSteps {
+			history = history[1:]
+		}
+		history = append(history, record(vm))
+	}
+	printDebugHelp()
+	for !vm.finished() {
+		output.Flush()
+		printUpcoming(vm)
+		fmt.Fprint(diagnostics, "(debug) ")
+		var line, readErr = input.ReadString('\n')
+		if readErr != nil {
+			return nil
+		}
+
+		switch strings.TrimSpace(line) {
+		case "step", "s":
+			remember()
+			if err = vm.run(1); err != nil && !isBreakpoint(err) {
+				return vm.program.locate(err, vm.pc)
+			}
+		case "continue", "c":
+			if err = vm.run(-1); err != nil && !isBreakpoint(err) {
+				return vm.program.locate(err, vm.pc)
+			}
+		case "match", "m":
+			var instruction = vm.instructions[vm.pc]
+			if instruction.Type == JMP_ZER || instruction.Type == JMP_NOT_ZER {
+				remember()
+				vm.pc = instruction.Data
+			} else {
+				parseMessage("", "The next instruction is not a bracket", Warning)
+			}
+		case "back", "b":
+			if rewindSteps == 0 {
+				parseMessage("", "Stepping back is disabled, start goof with -rewind to enable it", Warning)
+			} else if len(history) == 0 {
+				parseMessage("", "No more steps to undo", Warning)
+			} else {
+				restore(vm, history[len(history)-1])
+				history = history[:len(history)-1]
+			}
+		case "dump":
+			dumpMem(cells, cellptr)
+		case "quit", "q":
+			return nil
+		default:
+			printDebugHelp()
+		}
+	}
+	output.Flush()
+	fmt.Fprintln(diagnostics, "Program finished")
+
+	return nil
+}
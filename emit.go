@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// emitFile compiles a file and writes it out in the -emit format instead of
+// running it
+func emitFile(filename string, code string, opts Options) error {
+	var program, err = Compile(code, opts)
+	if err != nil {
+		reportFileError(filename, err)
+		return err
+	}
+	switch emitFormat {
+	case "dot":
+		emitDot(output, program.Instructions)
+	case "wat":
+		err = emitWat(output, program.Instructions)
+	case "wasm":
+		err = emitWasm(output, program.Instructions)
+	}
+	if err != nil {
+		reportFileError(filename, err)
+		return err
+	}
+	return output.Flush()
+}
+
+// jumpTarget returns where a jump instruction continues when it's taken
+func jumpTarget(instruction Instruction) (target int, ok bool) {
+	switch instruction.Type {
+	case JMP_ZER, JMP_NOT_ZER, SKP_ZER:
+		return instruction.Data + 1, true
+	}
+	return 0, false
+}
+
+// emitDot writes the control flow of instructions as a Graphviz graph. Each
+// node is a run of instructions that always execute together and edges are
+// labelled with the condition a jump takes them on.
+func emitDot(w io.Writer, instructions []Instruction) {
+	// A block starts at the program start, wherever a jump lands and after
+	// every jump, and the last one ends with the program
+	var starts = make([]bool, len(instructions)+1)
+	starts[0] = true
+	starts[len(instructions)] = true
+	for pc, instruction := range instructions {
+		if target, ok := jumpTarget(instruction); ok {
+			starts[target] = true
+			starts[pc+1] = true
+		}
+	}
+	var node = func(pc int) string {
+		if pc == len(instructions) {
+			return "end"
+		}
+		return fmt.Sprintf("i%d", pc)
+	}
+
+	fmt.Fprintln(w, "digraph program {")
+	fmt.Fprintln(w, "\tnode [shape=box, fontname=monospace];")
+	fmt.Fprintln(w, "\tend [shape=doublecircle];")
+	for start := 0; start < len(instructions); {
+		var end = start + 1
+		for !starts[end] {
+			end++
+		}
+
+		var label strings.Builder
+		for pc := start; pc < end; pc++ {
+			if pc-start == 8 && end-pc > 1 {
+				fmt.Fprintf(&label, "... %d more\\l", end-pc)
+				break
+			}
+			fmt.Fprintf(&label, "%d %s %d\\l", pc, instructionNames[instructions[pc].Type], instructions[pc].Data)
+		}
+		fmt.Fprintf(w, "\t%s [label=\"%s\"];\n", node(start), label.String())
+
+		var last = instructions[end-1]
+		switch last.Type {
+		case JMP_ZER, SKP_ZER:
+			fmt.Fprintf(w, "\t%s -> %s [label=\"zero\"];\n", node(start), node(last.Data+1))
+			fmt.Fprintf(w, "\t%s -> %s [label=\"non-zero\"];\n", node(start), node(end))
+		case JMP_NOT_ZER:
+			fmt.Fprintf(w, "\t%s -> %s [label=\"non-zero\"];\n", node(start), node(last.Data+1))
+			fmt.Fprintf(w, "\t%s -> %s [label=\"zero\"];\n", node(start), node(end))
+		default:
+			fmt.Fprintf(w, "\t%s -> %s;\n", node(start), node(end))
+		}
+		start = end
+	}
+	fmt.Fprintln(w, "}")
+}
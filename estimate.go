@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// estimateFile compiles a file and prints a static estimate of how much work
+// running it takes, without running it
+func estimateFile(filename string, code string, opts Options) error {
+	var program, err = Compile(code, opts)
+	if err != nil {
+		reportFileError(filename, err)
+		return err
+	}
+
+	var counts = make([]int, len(instructionNames))
+	var depth, deepest, loops = 0, 0, 0
+	// Steps taken outside loops even when every copy loop is skipped
+	var minimum = 0
+	var skipUntil = -1
+	// Steps if every loop ran as many times as a cell has values
+	var heuristic = 0.0
+	var iterations = float64(cellMask) + 1
+	for pc, instruction := range program.Instructions {
+		counts[instruction.Type]++
+		if depth == 0 && pc > skipUntil {
+			minimum++
+		}
+		heuristic += math.Pow(iterations, float64(depth))
+		switch instruction.Type {
+		case JMP_ZER:
+			loops++
+			depth++
+			if depth > deepest {
+				deepest = depth
+			}
+		case JMP_NOT_ZER:
+			depth--
+		case SKP_ZER:
+			if depth == 0 {
+				skipUntil = instruction.Data
+			}
+		}
+	}
+
+	fmt.Fprintf(output, "%s\n", filename)
+	fmt.Fprintf(output, "%-12s %8s\n", "Instruction", "Count")
+	for instructionType, count := range counts {
+		if count > 0 {
+			fmt.Fprintf(output, "%-12s %8d\n", instructionNames[instructionType], count)
+		}
+	}
+	fmt.Fprintf(output, "%-12s %8d\n", "Total", len(program.Instructions))
+	fmt.Fprintf(output, "Loops: %d, nested up to %d deep\n", loops, deepest)
+	switch {
+	case loops == 0 && counts[SKP_ZER] == 0:
+		fmt.Fprintf(output, "Estimate: exactly %d steps, there are no loops\n", minimum)
+	case loops == 0:
+		fmt.Fprintf(output, "Estimate: %d to %d steps, there are no loops\n", minimum, len(program.Instructions))
+	default:
+		fmt.Fprintf(output, "Estimate: at least %d steps, unbounded in general; about %.3g if every loop ran %g times, roughly O(n^%d)\n", minimum, heuristic, iterations, deepest)
+	}
+	return output.Flush()
+}
+
+// countFile compiles a file and prints the number of instructions it compiled
+// to, prefixed with the file name when several files are given
+func countFile(filename string, code string, opts Options) error {
+	var program, err = Compile(code, opts)
+	if err != nil {
+		reportFileError(filename, err)
+		return err
+	}
+
+	if len(filenames) > 1 {
+		fmt.Fprintf(output, "%s: ", filename)
+	}
+	fmt.Fprintf(output, "%d\n", len(program.Instructions))
+	return output.Flush()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+)
+
+// Set by -seed
+var tapeSeed int64
+var seededTape bool
+
+// randomTape returns a tape filled with pseudo-random cell values from seed
+func randomTape(seed int64) []uint32 {
+	var random = rand.New(rand.NewSource(seed))
+	var cells = make([]uint32, memorySize)
+	for i := range cells {
+		cells[i] = random.Uint32() & cellMask
+	}
+	return cells
+}
+
+// seededRun is the outcome of running a program on a random tape
+type seededRun struct {
+	cells   []uint32
+	cellptr int
+	output  []byte
+	err     error
+}
+
+// runOnRandomTape runs code on the tape made from -seed, with input taken from
+// the given bytes and output captured instead of written
+func runOnRandomTape(code string, opts Options, inputData []byte) seededRun {
+	var run = seededRun{cells: randomTape(tapeSeed), cellptr: tapeOrigin()}
+	resetBanks()
+	run.output = captureRun(bytes.NewReader(inputData), func() {
+		run.err = RunOn(run.cells, &run.cellptr, code, opts)
+	})
+	return run
+}
+
+// runSeeded runs code on a random tape from -seed both with and without the
+// optimizer and fails if they disagree, which points at an optimization that
+// wrongly assumes a cell is zero. Programs that read input have it read in
+// full first so both runs see the same bytes. The optimized run's output and tape are kept.
+func runSeeded(code string, opts Options, cells *[]uint32, cellptr *int) error {
+	var inputData []byte
+	if strings.ContainsRune(code, ',') {
+		var err error
+		if inputData, err = io.ReadAll(programInput); err != nil {
+			return newError(ExitIO, "%s", err)
+		}
+	}
+
+	var unoptimized = opts
+	unoptimized.OptPasses = 0
+	var expected = runOnRandomTape(code, unoptimized, inputData)
+	var actual = runOnRandomTape(code, opts, inputData)
+	*cells, *cellptr = actual.cells, actual.cellptr
+	output.Write(actual.output)
+	output.Flush()
+
+	var difference string
+	switch {
+	case (expected.err == nil) != (actual.err == nil):
+		difference = fmt.Sprintf("only one of them failed (unoptimized: %v, optimized: %v)", expected.err, actual.err)
+	case !bytes.Equal(expected.output, actual.output):
+		difference = "their output differs"
+	case expected.err != nil:
+	case expected.cellptr != actual.cellptr:
+		difference = fmt.Sprintf("the pointer ended on cell %d unoptimized and on cell %d optimized", expected.cellptr, actual.cellptr)
+	case !reflect.DeepEqual(expected.cells, actual.cells):
+		difference = "their tapes differ"
+	}
+	if difference != "" {
+		return newError(ExitRuntime, "Optimized and unoptimized runs on the tape from -seed %d disagree: %s", tapeSeed, difference)
+	}
+	return actual.err
+}
@@ -1,5 +1,5 @@
 module goof
 
-go 1.16
+go 1.18
 
 require github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Hook handles a custom command. It may change any cell and move the pointer,
+// and an error it returns stops the program.
+type Hook func(cells []uint32, cellptr *int) error
+
+// hooks maps custom command characters to their handlers. There are none
+// unless an extension like -debugext registers them.
+var hooks = map[byte]Hook{}
+
+// RegisterHook makes char a command that calls hook when executed, like an
+// extension built into the VM. Characters that already mean something to goof
+// can't be taken. It's exported for embedders along with RunOn, and stays in
+// package main with it until the VM can be imported.
+func RegisterHook(char byte, hook Hook) error {
+	if strings.IndexByte("+-<>[].,{}^_@CRLP!;", char) != -1 || char <= ' ' {
+		return fmt.Errorf("%q can't be used for a hook", char)
+	}
+	hooks[char] = hook
+	updateDummyChars()
+	return nil
+}
+
+// hookChars returns the characters that have a hook registered, in order
+func hookChars() string {
+	var chars = make([]byte, 0, len(hooks))
+	for char := range hooks {
+		chars = append(chars, char)
+	}
+	sort.Slice(chars, func(i, j int) bool { return chars[i] < chars[j] })
+	return string(chars)
+}
+
+// runHook calls the hook registered for char, checking that it left the
+// pointer on the tape
+func runHook(char byte, cells []uint32, cellptr *int, pc int) error {
+	if err := hooks[char](cells, cellptr); err != nil {
+		return newError(ExitRuntime, "Hook %q failed: %s (instruction %d)", char, err, pc)
+	}
+	if *cellptr < 0 || *cellptr >= len(cells) {
+		return newError(ExitRuntime, "Hook %q moved the pointer out of the tape to cell %d (instruction %d)", char, *cellptr, pc)
+	}
+	return nil
+}
+
+// registerDebugExtensions adds the commands enabled by -debugext, which print
+// the state of the program to stderr
+func registerDebugExtensions() {
+	RegisterHook('#', func(cells []uint32, cellptr *int) error {
+		output.Flush()
+		dumpMem(&cells, cellptr)
+		return nil
+	})
+	RegisterHook('$', func(cells []uint32, cellptr *int) error {
+		output.Flush()
+		fmt.Fprintln(diagnostics, "Pointer:", *cellptr-tapeOrigin())
+		return nil
+	})
+	RegisterHook('?', func(cells []uint32, cellptr *int) error {
+		output.Flush()
+		fmt.Fprintf(diagnostics, "Cell %d: %d\n", *cellptr-tapeOrigin(), cellValue(cells[*cellptr]))
+		return nil
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	if err := RegisterHook('*', func(cells []uint32, cellptr *int) error {
+		cells[*cellptr] += 10
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		delete(hooks, '*')
+		resetFlags()
+	}()
+	if err := RegisterHook('[', nil); err == nil {
+		t.Error("[ was accepted as a hook")
+	}
+
+	// Both optimizers keep hook characters and strip the rest
+	for _, regex := range []bool{false, true} {
+		regexOptimizer = regex
+		if tokens, _, _ := Optimize("+=*a.", 2); tokens != "+*." {
+			t.Errorf("regexopt %t: got %q, want \"+*.\"", regex, tokens)
+		}
+	}
+	regexOptimizer = false
+	checkLevels(t, "+*.>**.", "", "\x0b\x14")
+}
+
+func TestDebugExtensions(t *testing.T) {
+	registerDebugExtensions()
+	defer func() {
+		for _, c := range "#$?" {
+			delete(hooks, byte(c))
+		}
+		resetFlags()
+	}()
+	var messages strings.Builder
+	diagnostics, biasTape, memorySize = &messages, true, 20
+	// Cells are numbered from where the pointer starts, on a biased tape too
+	if _, _, _, err := runCode(t, ">>++?$<<<-?$", "", unoptimized); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Cell 2: 2\nPointer: 2\nCell -1: 255\nPointer: -1\n"; messages.String() != want {
+		t.Errorf("got %q, want %q", messages.String(), want)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+)
+
+// interrupted is set by the first Ctrl-C while a program runs. The VM checks
+// it on every jump back to the start of a loop and stops the program.
+var interrupted int32
+
+// running is non-zero while Exec runs a program
+var running int32
+
+// handleInterrupts makes the first Ctrl-C during a run stop the program
+// cleanly, so its memory can still be dumped. A second Ctrl-C, or one while
+// no program is running, quits immediately.
+func handleInterrupts() {
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for range signals {
+			if atomic.LoadInt32(&running) == 0 || atomic.LoadInt32(&interrupted) != 0 {
+				os.Exit(ExitInterrupt)
+			}
+			atomic.StoreInt32(&interrupted, 1)
+		}
+	}()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"syscall"
+	"unsafe"
+)
+
+const jitSupported = true
+
+// jitCall enters generated code at the given instruction index. It returns the
+// index of the instruction the generated code could not handle itself (or the
+// program length when it finished) and the updated cell pointer. Loops bail
+// out when *stop becomes non-zero.
+func jitCall(code uintptr, tape unsafe.Pointer, ptr int, length int, entry int, stop *int32) (pc int, newPtr int)
+
+// jitAssembler lowers instructions to x86-64 machine code. While the generated
+// code runs, RDI holds the tape base, RSI the cell pointer, RDX the tape
+// length and R10 the address of the interrupt flag. RCX, RAX, R8 and R9 are
+// scratch registers.
+type jitAssembler struct {
+	code   []byte
+	labels []int // Code offset of each instruction, plus one for the end
+	jumps  []jitPatch
+	bails  []jitPatch
+}
+
+// jitPatch is a rel32 operand at offset at that must point to target, which is
+// an instruction index for jumps and the instruction to bail out on for bails
+type jitPatch struct {
+	at     int
+	target int
+}
+
+func (a *jitAssembler) emit(b ...byte) {
+	a.code = append(a.code, b...)
+}
+
+func (a *jitAssembler) emit32(v int) {
+	var u = uint32(int32(v))
+	a.code = append(a.code, byte(u), byte(u>>8), byte(u>>16), byte(u>>24))
+}
+
+func (a *jitAssembler) jumpTo(target int, opcode ...byte) {
+	a.emit(opcode...)
+	a.jumps = append(a.jumps, jitPatch{len(a.code), target})
+	a.emit32(0)
+}
+
+func (a *jitAssembler) bailIf(pc int, opcode ...byte) {
+	a.emit(opcode...)
+	a.bails = append(a.bails, jitPatch{len(a.code), pc})
+	a.emit32(0)
+}
+
+// exit returns to Go, reporting pc as the instruction to continue from
+func (a *jitAssembler) exit(pc int) {
+	a.emit(0xB8) // mov eax, pc
+	a.emit32(pc)
+	a.emit(0xC3) // ret
+}
+
+// movePointer moves RSI by offset, bailing out on pc if that would leave the tape
+func (a *jitAssembler) movePointer(pc int, offset int) {
+	a.emit(0x48, 0x8D, 0x8E) // lea rcx, [rsi+offset]
+	a.emit32(offset)
+	a.emit(0x48, 0x39, 0xD1) // cmp rcx, rdx
+	a.bailIf(pc, 0x0F, 0x83) // jae bail
+	a.emit(0x48, 0x89, 0xCE) // mov rsi, rcx
+}
+
+// The adds below only touch as many low bytes of a cell as the cell size
+// allows, so they wrap without masking and leave the upper bytes zero.
+
+// addImmediate adds data to the cell addressed by the given SIB byte
+func (a *jitAssembler) addImmediate(sib byte, data int) {
+	switch cellMask {
+	case 0xFF:
+		a.emit(0x80, 0x04, sib, byte(data)) // add byte [rdi+reg*4], data
+	case 0xFFFF:
+		a.emit(0x66, 0x81, 0x04, sib, byte(data), byte(data>>8)) // add word [rdi+reg*4], data
+	default:
+		a.emit(0x81, 0x04, sib) // add dword [rdi+reg*4], data
+		a.emit32(data)
+	}
+}
+
+// addEAX adds EAX to the cell addressed by the given SIB byte
+func (a *jitAssembler) addEAX(sib byte) {
+	switch cellMask {
+	case 0xFF:
+		a.emit(0x00, 0x04, sib) // add byte [rdi+reg*4], al
+	case 0xFFFF:
+		a.emit(0x66, 0x01, 0x04, sib) // add word [rdi+reg*4], ax
+	default:
+		a.emit(0x01, 0x04, sib) // add dword [rdi+reg*4], eax
+	}
+}
+
+const (
+	sibCell   = 0xB7 // [rdi+rsi*4]
+	sibTarget = 0x8F // [rdi+rcx*4]
+)
+
+func (a *jitAssembler) assemble(instructions []Instruction) {
+	// Entry: jump to the instruction whose index is in RCX through the table
+	// appended after the code
+	a.emit(0x4C, 0x8D, 0x05) // lea r8, [rip+table]
+	var tableRef = len(a.code)
+	a.emit32(0)
+	a.emit(0x4D, 0x63, 0x0C, 0x88) // movsxd r9, dword [r8+rcx*4]
+	a.emit(0x4D, 0x01, 0xC1)       // add r9, r8
+	a.emit(0x41, 0xFF, 0xE1)       // jmp r9
+
+	a.labels = make([]int, len(instructions)+1)
+	for pc, instruction := range instructions {
+		a.labels[pc] = len(a.code)
+		switch instruction.Type {
+		case ADD_SUB:
+			a.addImmediate(sibCell, instruction.Data)
+		case PTR_MOV:
+			a.movePointer(pc, instruction.Data)
+		case JMP_ZER:
+			a.emit(0x83, 0x3C, sibCell, 0x00) // cmp dword [rdi+rsi*4], 0
+			a.jumpTo(instruction.Data+1, 0x0F, 0x84)
+		case JMP_NOT_ZER:
+			a.emit(0x83, 0x3C, sibCell, 0x00)
+			a.emit(0x74, 15)               // je past the jump back
+			a.emit(0x41, 0x83, 0x3A, 0x00) // cmp dword [r10], 0
+			a.bailIf(pc, 0x0F, 0x85)       // jne bail
+			a.jumpTo(instruction.Data+1, 0xE9)
+		case CLR:
+			a.emit(0xC7, 0x04, sibCell) // mov dword [rdi+rsi*4], 0
+			a.emit32(0)
+		case SET_VAL:
+			a.emit(0xC7, 0x04, sibCell) // mov dword [rdi+rsi*4], value
+			a.emit32(instruction.Data)
+		case SKP_ZER:
+			a.emit(0x83, 0x3C, sibCell, 0x00)
+			a.jumpTo(instruction.Data+1, 0x0F, 0x84)
+		case MUL_CPY:
+			a.emit(0x48, 0x8D, 0x8E) // lea rcx, [rsi+offset]
+			a.emit32(instruction.Data)
+			a.emit(0x48, 0x39, 0xD1) // cmp rcx, rdx
+			a.bailIf(pc, 0x0F, 0x83)
+			a.emit(0x8B, 0x04, sibCell) // mov eax, [rdi+rsi*4]
+			a.emit(0x69, 0xC0)          // imul eax, eax, multiplier
+			a.emit32(instruction.AuxData)
+			a.addEAX(sibTarget)
+		case SCN_RGT, SCN_LFT:
+			if instruction.Data <= 0 {
+				// Leave reporting the bad step to the interpreter
+				a.exit(pc)
+				continue
+			}
+			var step = instruction.Data
+			if instruction.Type == SCN_LFT {
+				step = -step
+			}
+			var loop = len(a.code)
+			a.emit(0x83, 0x3C, sibCell, 0x00)
+			a.jumpTo(pc+1, 0x0F, 0x84)
+			a.movePointer(pc, step)
+			a.emit(0xE9) // jmp loop
+			a.emit32(loop - (len(a.code) + 4))
+		default:
+			// I/O and extensions are left to the interpreter
+			a.exit(pc)
+		}
+	}
+	a.labels[len(instructions)] = len(a.code)
+	a.exit(len(instructions))
+
+	for _, bail := range a.bails {
+		a.patch(bail.at, len(a.code))
+		a.exit(bail.target)
+	}
+	for _, jump := range a.jumps {
+		a.patch(jump.at, a.labels[jump.target])
+	}
+
+	for len(a.code)%4 != 0 {
+		a.emit(0xCC)
+	}
+	var table = len(a.code)
+	a.patch(tableRef, table)
+	for _, label := range a.labels {
+		a.emit32(label - table)
+	}
+}
+
+// patch points the rel32 operand at offset at to target
+func (a *jitAssembler) patch(at int, target int) {
+	binary.LittleEndian.PutUint32(a.code[at:], uint32(int32(target-(at+4))))
+}
+
+// runJIT runs the machine's program as native code, handing instructions the
+// generated code can't execute to the interpreter one at a time
+func runJIT(vm *machine) error {
+	if len(*vm.cells) == 0 {
+		return vm.run(-1)
+	}
+
+	var assembler jitAssembler
+	assembler.assemble(vm.instructions)
+	var memory, err = syscall.Mmap(-1, 0, len(assembler.code), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return vm.run(-1)
+	}
+	defer syscall.Munmap(memory)
+	copy(memory, assembler.code)
+	if err = syscall.Mprotect(memory, syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		return vm.run(-1)
+	}
+
+	var entry = uintptr(unsafe.Pointer(&memory[0]))
+	for !vm.finished() {
+		var cells = *vm.cells
+		vm.pc, *vm.cellptr = jitCall(entry, unsafe.Pointer(&cells[0]), *vm.cellptr, len(cells), vm.pc, &interrupted)
+		if vm.finished() {
+			break
+		}
+		if err = vm.run(1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
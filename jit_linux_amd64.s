@@ -0,0 +1,14 @@
+#include "textflag.h"
+
+// func jitCall(code uintptr, tape unsafe.Pointer, ptr int, length int, entry int, stop *int32) (pc int, newPtr int)
+TEXT ·jitCall(SB), NOSPLIT, $8-64
+	MOVQ code+0(FP), AX
+	MOVQ tape+8(FP), DI
+	MOVQ ptr+16(FP), SI
+	MOVQ length+24(FP), DX
+	MOVQ entry+32(FP), CX
+	MOVQ stop+40(FP), R10
+	CALL AX
+	MOVQ AX, pc+48(FP)
+	MOVQ SI, newPtr+56(FP)
+	RET
@@ -0,0 +1,10 @@
+//go:build !linux || !amd64
+// +build !linux !amd64
+
+package main
+
+const jitSupported = false
+
+func runJIT(vm *machine) error {
+	return vm.run(-1)
+}
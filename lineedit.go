@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// errLineInterrupted is returned by editLine when Ctrl-C is pressed
+var errLineInterrupted = errors.New("interrupted")
+
+// readLine reads a REPL line after prompt has been printed. On a terminal the
+// line is edited by goof itself, so Tab can complete commands, otherwise
+// lines are read as they come.
+func readLine(prompt string) (string, error) {
+	if isTerminal(os.Stdin) {
+		if restore, ok := makeRaw(os.Stdin); ok {
+			var line, err = editLine(input, diagnostics, prompt)
+			restore()
+			if errors.Is(err, errLineInterrupted) {
+				// The terminal doesn't send the signal in raw mode, this
+				// quits like a Ctrl-C while no program runs does
+				os.Exit(ExitInterrupt)
+			}
+			return line, err
+		}
+	}
+	return input.ReadString('\n')
+}
+
+// editLine reads a line from a terminal in raw mode, echoing it to echo.
+// Backspace deletes the last character, Tab completes the command the line
+// starts with and escape sequences such as arrow keys are ignored. Ctrl-D on
+// an empty line is the end of input.
+func editLine(keys *bufio.Reader, echo io.Writer, prompt string) (string, error) {
+	var line []byte
+	for {
+		var key, err = keys.ReadByte()
+		if err != nil {
+			return string(line), err
+		}
+
+		switch {
+		case key == '\r' || key == '\n':
+			fmt.Fprintln(echo)
+			return string(line) + "\n", nil
+		case key == 0x04:
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+		case key == 0x03:
+			fmt.Fprintln(echo, "^C")
+			return "", errLineInterrupted
+		case key == 0x7F || key == '\b':
+			if len(line) > 0 {
+				var _, size = utf8.DecodeLastRune(line)
+				line = line[:len(line)-size]
+				fmt.Fprint(echo, "\b \b")
+			}
+		case key == '\t':
+			var completed, candidates = completeCommand(string(line))
+			if len(candidates) > 1 && completed == string(line) {
+				fmt.Fprint(echo, "\n"+strings.Join(candidates, "  ")+"\n"+prompt+completed)
+			} else {
+				fmt.Fprint(echo, completed[len(line):])
+			}
+			line = []byte(completed)
+		case key == 0x1B:
+			// Drop CSI sequences like ESC [ A up to their final byte
+			if next, _ := keys.ReadByte(); next == '[' {
+				for {
+					var b, err = keys.ReadByte()
+					if err != nil || (b >= 0x40 && b <= 0x7E) {
+						break
+					}
+				}
+			}
+		case key >= 0x20:
+			line = append(line, key)
+			echo.Write([]byte{key})
+		}
+	}
+}
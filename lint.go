@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// lintWarning is a suspicious construct found by lint, at a 1-based line and
+// column of the source
+type lintWarning struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+// sourceToken is a Brainfuck command together with its position in the source
+type sourceToken struct {
+	char   byte
+	line   int
+	column int
+}
+
+// sourceTokens extracts the commands from code, remembering where each one
+// came from
+func sourceTokens(code string) []sourceToken {
+	var commands = commandChars()
+
+	var tokens = make([]sourceToken, 0)
+	var line, column = 1, 0
+	for i := 0; i < len(code); i++ {
+		column++
+		if code[i] == '\n' {
+			line++
+			column = 0
+		} else if strings.IndexByte(commands, code[i]) != -1 {
+			tokens = append(tokens, sourceToken{code[i], line, column})
+		}
+	}
+	return tokens
+}
+
+// matchBrackets returns the index of the matching bracket for every bracket
+// in tokens, or -1 for unmatched brackets and other commands
+func matchBrackets(tokens []sourceToken) []int {
+	var match = make([]int, len(tokens))
+	var stack = make([]int, 0)
+	for i, token := range tokens {
+		match[i] = -1
+		switch token.char {
+		case '[':
+			stack = append(stack, i)
+		case ']':
+			if len(stack) > 0 {
+				var start = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				match[start], match[i] = i, start
+			}
+		}
+	}
+	return match
+}
+
+// analyzeLoops reports for every [ in tokens whether its loop is balanced,
+// meaning it always returns the pointer to where it started, and lists the
+// loops that can never terminate once entered: innermost balanced loops
+// whose body has no net effect on their own cell. Loops that start where
+// the cell is known to be zero (at the very beginning or right after another
+// loop) are never entered and are left out, as that's how comments are
+// usually written.
+func analyzeLoops(tokens []sourceToken, match []int) (balanced []bool, endless []int) {
+	balanced = make([]bool, len(tokens))
+	endless = make([]int, 0)
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if tokens[i].char != '[' || match[i] == -1 {
+			continue
+		}
+		var offset = 0
+		var innermost = true
+		var change = 0
+		var read = false
+		balanced[i] = true
+		for j := i + 1; j < match[i]; j++ {
+			switch tokens[j].char {
+			case '>':
+				offset++
+			case '<':
+				offset--
+			case '+':
+				if offset == 0 {
+					change++
+				}
+			case '-':
+				if offset == 0 {
+					change--
+				}
+			case ',', '_', bankChar:
+				read = read || offset == 0
+			case '[':
+				innermost = false
+				if match[j] != -1 {
+					balanced[i] = balanced[i] && balanced[j]
+					j = match[j]
+				}
+			default:
+				// Hooks may change any cell and move the pointer
+				if _, hook := hooks[tokens[j].char]; hook {
+					read = true
+					balanced[i] = false
+				}
+			}
+		}
+		balanced[i] = balanced[i] && offset == 0
+		var skipped = i == 0 || tokens[i-1].char == ']'
+		if balanced[i] && innermost && change == 0 && !read && !skipped {
+			endless = append(endless, i)
+		}
+	}
+	sort.Ints(endless)
+	return balanced, endless
+}
+
+// quoteSource returns the given line of source followed by a caret under the
+// given column, for appending to a message. Tabs before the column are kept
+// so the caret lines up whatever the tab width.
+func quoteSource(source string, line int, column int) string {
+	var lines = strings.Split(source, "\n")
+	if line < 1 || line > len(lines) || column < 1 || column > len(lines[line-1]) {
+		return ""
+	}
+	var text = lines[line-1]
+	var indent = strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, text[:column-1])
+	return "\n    " + text + "\n    " + indent + "^"
+}
+
+// checkEndlessLoops warns about loops in code that can never terminate once
+// entered, or fails with a syntax error under -endless-error. Positions are
+// quoted from source, which has the same layout as code.
+func checkEndlessLoops(code string, source string) error {
+	var tokens = sourceTokens(code)
+	var _, endless = analyzeLoops(tokens, matchBrackets(tokens))
+	if len(endless) == 0 {
+		return nil
+	}
+
+	var first = tokens[endless[0]]
+	var message = fmt.Sprintf("Loop at line %d, column %d can never terminate once entered", first.line, first.column)
+	if len(endless) > 1 {
+		message += fmt.Sprintf(" (and %d more)", len(endless)-1)
+	}
+	message += quoteSource(source, first.line, first.column)
+	if endlessLoopErrors {
+		return newError(ExitSyntax, "%s", message)
+	}
+	parseMessage("", message, Warning)
+	return nil
+}
+
+// checkPointerUnderflow fails with a syntax error when code moves the pointer
+// below cell 0 before its first loop, which is certain to fault at runtime
+// for a program that starts at the tape origin. Runs of < and > are folded
+// into one move, like the compiler does, so only where a run leaves the
+// pointer counts; the error points at the command that first took it below.
+func checkPointerUnderflow(code string, source string) error {
+	if wrapPointer {
+		return nil
+	}
+	var tokens = sourceTokens(code)
+	var pointer = tapeOrigin()
+	var below = -1 // The token in the current run that first took the pointer below cell 0
+	for i, token := range tokens {
+		switch token.char {
+		case '[':
+			return nil
+		case '>':
+			pointer++
+		case '<':
+			pointer--
+		default:
+			if _, hook := hooks[token.char]; hook {
+				return nil
+			}
+		}
+		if pointer < 0 && below == -1 {
+			below = i
+		}
+
+		var runEnds = i+1 == len(tokens) || (tokens[i+1].char != '<' && tokens[i+1].char != '>')
+		if runEnds && pointer < 0 {
+			var at = tokens[below]
+			return newError(ExitSyntax, "Pointer moves below cell 0 at line %d, column %d%s", at.line, at.column, quoteSource(source, at.line, at.column))
+		}
+		if runEnds {
+			below = -1
+		}
+	}
+	return nil
+}
+
+// checkStrict fails with a lint error when code contains anything but
+// commands and whitespace, for -strict
+func checkStrict(code string, source string) error {
+	var commands = commandChars()
+
+	var stray = make([]sourceToken, 0)
+	var line, column = 1, 0
+	for i := 0; i < len(code); i++ {
+		column++
+		if code[i] == '\n' {
+			line++
+			column = 0
+		} else if strings.IndexByte(commands+" \t\r\f\v", code[i]) == -1 {
+			stray = append(stray, sourceToken{code[i], line, column})
+		}
+	}
+	if len(stray) == 0 {
+		return nil
+	}
+
+	var first = stray[0]
+	var message = fmt.Sprintf("Stray character %q at line %d, column %d", first.char, first.line, first.column)
+	if len(stray) > 1 {
+		message += fmt.Sprintf(" (and %d more)", len(stray)-1)
+	}
+	return newError(ExitLint, "%s%s", message, quoteSource(source, first.line, first.column))
+}
+
+// lint looks for constructs in code that are probably mistakes without
+// running it: unmatched brackets, loops that can never terminate once
+// entered and pointer movements that leave the tape
+func lint(code string) []lintWarning {
+	var tokens = sourceTokens(code)
+	var warnings = make([]lintWarning, 0)
+	var warn = func(token sourceToken, format string, a ...interface{}) {
+		warnings = append(warnings, lintWarning{token.line, token.column, fmt.Sprintf(format, a...)})
+	}
+
+	var match = matchBrackets(tokens)
+	for i, token := range tokens {
+		if token.char == '[' && match[i] == -1 {
+			warn(token, "Unmatched [")
+		} else if token.char == ']' && match[i] == -1 {
+			warn(token, "Unmatched ]")
+		}
+	}
+
+	var balanced, endless = analyzeLoops(tokens, match)
+	for _, i := range endless {
+		warn(tokens[i], "Loop has no net effect on its own cell and can't terminate once entered")
+	}
+
+	// The pointer position is known until the first loop that might move it
+	if !wrapPointer {
+		var pointer = tapeOrigin()
+		for i := 0; i < len(tokens); i++ {
+			var token = tokens[i]
+			if token.char == '[' && match[i] != -1 && !balanced[i] {
+				break
+			}
+			if _, hook := hooks[token.char]; hook {
+				break
+			}
+			switch token.char {
+			case '>':
+				pointer++
+			case '<':
+				pointer--
+			}
+			if pointer < 0 || pointer >= memorySize {
+				warn(token, "Pointer moves out of the tape to cell %d", pointer-tapeOrigin())
+				break
+			}
+		}
+	}
+
+	sort.Slice(warnings, func(i, j int) bool {
+		if warnings[i].Line != warnings[j].Line {
+			return warnings[i].Line < warnings[j].Line
+		}
+		return warnings[i].Column < warnings[j].Column
+	})
+	return warnings
+}
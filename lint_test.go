@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEndlessLoops(t *testing.T) {
+	endlessLoopErrors = true
+	defer resetFlags()
+	var tests = []struct {
+		code    string
+		endless bool
+	}{
+		{"+[]", true},
+		{"+[>]", false},
+		{"+[>+<]", true},
+		{"+[-]", false},
+		{"+[,]", false},
+		{"+[>-<]>[<+>]", true},
+		{"[>+<]", false},     // Never entered, like a comment
+		{"+[[-]>+<]", false}, // Only innermost loops are checked
+	}
+	for _, test := range tests {
+		var err = checkEndlessLoops(test.code, test.code)
+		if (err != nil) != test.endless {
+			t.Errorf("%s: got %v, want endless %t", test.code, err, test.endless)
+		} else if err != nil && exitCode(err) != ExitSyntax {
+			t.Errorf("%s: exit status %d, want %d", test.code, exitCode(err), ExitSyntax)
+		}
+	}
+}
+
+func TestEndlessLoopWarning(t *testing.T) {
+	var messages bytes.Buffer
+	diagnostics = &messages
+	defer resetFlags()
+	if _, err := Compile("+\n+[>+<]", Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(messages.String(), "Loop at line 2, column 2 can never terminate once entered") {
+		t.Errorf("got %q", messages.String())
+	}
+}
+
+func TestPointerUnderflow(t *testing.T) {
+	defer resetFlags()
+	var tests = []struct {
+		code    string
+		message string
+	}{
+		{"+++<<<.", "line 1, column 4"},
+		{"><<", "line 1, column 3"},
+		{"+>.<<>>", ""},
+		// Runs are folded first, so a < undone by the > after it is fine
+		{"<>+.", ""},
+		{"< x >", ""},
+		{"<<>+", "line 1, column 1"},
+		{"[<]<", ""}, // Nothing is known once a loop starts
+	}
+	for _, test := range tests {
+		var err = checkPointerUnderflow(test.code, test.code)
+		if test.message == "" && err != nil {
+			t.Errorf("%s: got %v, want no error", test.code, err)
+		} else if test.message != "" && (exitCode(err) != ExitSyntax || !strings.Contains(err.Error(), test.message)) {
+			t.Errorf("%s: got %v, want an error at %s", test.code, err, test.message)
+		}
+	}
+
+	var code, err = os.ReadFile("testprogs/underflow.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkPointerUnderflow(string(code), string(code)); exitCode(err) != ExitSyntax || !strings.Contains(err.Error(), "Pointer moves below cell 0 at line 3, column 4") {
+		t.Errorf("underflow.b: got %v", err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	var tests = []struct {
+		args   []string
+		status int
+		stderr string
+	}{
+		{[]string{"-strict", "-comments"}, ExitLint, "Stray character 'x' at line 3, column 25"},
+		// Without -comments the comment is stray too
+		{[]string{"-strict"}, ExitLint, "Stray character ';' at line 1, column 1 (and 101 more)"},
+		{[]string{"-comments"}, ExitOK, ""},
+	}
+	for _, test := range tests {
+		var stdout, stderr, status = runGoof(t, "", append(test.args, "testprogs/strict.b")...)
+		if status != test.status || !strings.Contains(stderr, test.stderr) {
+			t.Errorf("%v: exited with %d and printed %q, want %d and %q", test.args, status, stderr, test.status, test.stderr)
+		}
+		if status == ExitOK && stdout != "A" {
+			t.Errorf("%v: printed %q, want \"A\"", test.args, stdout)
+		}
+	}
+}
@@ -2,17 +2,27 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/mitchellh/colorstring"
 )
 
+// Version is the version of goof reported by the REPL banner and -version
+const Version = "1.0.2"
+
 // Instruction types
 const (
 	ADD_SUB byte = iota
@@ -25,8 +35,35 @@ const (
 	MUL_CPY
 	SCN_RGT
 	SCN_LFT
+	AUX_MOV
+	AUX_STR
+	AUX_LOD
+	SKP_ZER
+	SET_VAL
+	BNK_NXT
+	HOOK
 )
 
+var instructionNames = [...]string{
+	ADD_SUB:     "ADD_SUB",
+	PTR_MOV:     "PTR_MOV",
+	JMP_ZER:     "JMP_ZER",
+	JMP_NOT_ZER: "JMP_NOT_ZER",
+	PUT_CHR:     "PUT_CHR",
+	RAD_CHR:     "RAD_CHR",
+	CLR:         "CLR",
+	MUL_CPY:     "MUL_CPY",
+	SCN_RGT:     "SCN_RGT",
+	SCN_LFT:     "SCN_LFT",
+	AUX_MOV:     "AUX_MOV",
+	AUX_STR:     "AUX_STR",
+	AUX_LOD:     "AUX_LOD",
+	SKP_ZER:     "SKP_ZER",
+	SET_VAL:     "SET_VAL",
+	BNK_NXT:     "BNK_NXT",
+	HOOK:        "HOOK",
+}
+
 // Message types
 const (
 	Info byte = iota
@@ -34,24 +71,214 @@ const (
 	Error
 )
 
+// Exit statuses used in file-execution mode. 1 is used for invalid flag
+// values and 2 is reserved by the flag package for unknown flags.
+const (
+	ExitOK       = 0
+	ExitSyntax   = 3 // The program failed to compile, e.g. unbalanced brackets
+	ExitIO       = 4 // A file could not be read or written
+	ExitRuntime  = 5 // The program did something invalid while running
+	ExitLint     = 6 // -lint-strict found suspicious constructs, or -strict stray characters
+	ExitSelfTest = 7 // -selftest found a program that misbehaved
+
+	ExitInterrupt = 130 // The program was stopped with Ctrl-C
+)
+
+// VMError is an error raised while loading, compiling or running a program.
+// Code is the process exit status it maps to.
+type VMError struct {
+	Code    int
+	Message string
+}
+
+func (e *VMError) Error() string {
+	return e.Message
+}
+
+func newError(code int, format string, a ...interface{}) error {
+	return &VMError{code, fmt.Sprintf(format, a...)}
+}
+
+// exitCode returns the exit status for err
+func exitCode(err error) int {
+	var vmErr *VMError
+	if err == nil {
+		return ExitOK
+	} else if errors.As(err, &vmErr) {
+		return vmErr.Code
+	}
+	return 1
+}
+
 type Instruction struct {
 	Type    byte
 	Data    int
 	AuxData int
 }
 
-var filename string
+// fileList collects the values of a flag that may be given several times
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *fileList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// cellList collects the cell indices of a flag that may be given several times
+type cellList []int
+
+func (c *cellList) String() string {
+	return fmt.Sprint(*c)
+}
+
+func (c *cellList) Set(value string) error {
+	var cell, err = strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*c = append(*c, cell)
+	return nil
+}
+
+// levelShorthand is a boolean flag like -O2 that sets -O to its level
+type levelShorthand int
+
+func (l levelShorthand) String() string {
+	return ""
+}
+
+func (l levelShorthand) Set(value string) error {
+	var set, err = strconv.ParseBool(value)
+	if set {
+		optLevel = int(l)
+	}
+	return err
+}
+
+func (l levelShorthand) IsBoolFlag() bool {
+	return true
+}
+
+// largeTape is the tape size above which -m warns about memory use
+const largeTape = 1 << 26
+
+var filenames fileList
+var outputFilename string
 var memorySize int
 var trackStatistics bool
 var dumpMemory bool
+var dumpMemoryFile string
+var showPointer bool
 var optPasses int
+var optLevel int
+var sizeOptimization bool
+var printVersion bool
+var trace bool
+var traceFrom int
+var traceTo int
+var auxSize int
+var bankCount int
+var jsonStatistics bool
+var statsFilename string
+
+// statsOutput is where -s statistics go, stderr unless -statsfile is given
+var statsOutput io.Writer = os.Stderr
+var pointerMode string
+var wrapPointer bool
+var cellSize int
+var cellMask uint32 = 0xFF
+var outputEncoding string
+var useJIT bool
+var echoInput bool
+var utf8Output bool
+var decimalOutput bool
+var signedCells bool
+
+var flushMode string
+var outputBufferSize int
+var flushChars bool
+var flushLines bool
+var fillValue uint
+var maxCell uint
+var semicolonComments bool
+var repeatRuns int
+var filterMode bool
+var strictSource bool
+var base64Output bool
+var maxDepth int
+var regexOptimizer bool
+var noOptimizeIO bool
+var lintOnly bool
+var lintStrict bool
+var endlessLoopErrors bool
+var asciiOnly string
+var asciiWarn bool
+var asciiError bool
+var cellPrompt bool
+var safeCheck bool
+var stepCount bool
+var bangInput bool
+var rewindSteps int
+var watchCells cellList
+var breakWhen string
+var emitFormat string
+var debugExtensions bool
+var tapeFilename string
+var tapeData []byte
+var tapeOutFilename string
+var estimateOnly bool
+var countOnly bool
+var showProgress bool
+var sparseDump bool
+var biasTape bool
+var xlateFilename string
+
+// outputTable maps every byte printed in byte encoding to the byte actually
+// written, when -xlate is given
+var outputTable *[256]byte
+var breakCell = -1
+var breakValue uint32
+
+// Everything goof prints besides program output goes to diagnostics, which
+// -quiet discards
+var quiet bool
+var diagnostics io.Writer = os.Stderr
+
+// Program output is buffered and flushed according to -flush, before input is
+// read and when a program ends
+var output = bufio.NewWriter(os.Stdout)
+
+// outputFile and statsFile are the files -out and -statsfile write to, if
+// given, which finishOutput closes
+var outputFile *os.File
+var statsFile *os.File
+
+// outputEncoder is what output writes to under -b64out. It holds back the
+// last bytes that don't make up a whole base64 group until it's closed.
+var outputEncoder io.WriteCloser
+var input = bufio.NewReader(os.Stdin)
+
+// Bytes read by , come from stdin unless -input or -inputfile supplies them
+var inputString string
+var inputFilename string
+var programInput = input
+
+// Auxiliary scratch tape, only used when the -aux extension is enabled
+var auxCells []uint32
+var auxCellptr int
 
 var instructionCount int
 var optInstructionCount int
 var stringLength int
+var bytesRead int // Bytes , has read from programInput, for -filter
 
 var preprocessorTime time.Duration
 var interpreterTime time.Duration
+var optimizerTime time.Duration // Part of preprocessorTime spent in Optimize
 var ioWait time.Duration
 
 func elapsed(what int) func() {
@@ -62,13 +289,88 @@ func elapsed(what int) func() {
 			preprocessorTime = time.Since(start)
 		case 1:
 			interpreterTime = time.Since(start) - ioWait
+		case 2:
+			optimizerTime = time.Since(start)
+		}
+	}
+}
+
+// isPrintableASCII reports whether c is a printable ASCII character, newline
+// or tab
+func isPrintableASCII(c uint32) bool {
+	return c == '\n' || c == '\t' || c >= ' ' && c <= '~'
+}
+
+// tapeOrigin returns the cell programs start on: the middle of the tape with
+// -biastape, so they can move left too, and cell 0 otherwise. Dumps number
+// cells from there.
+func tapeOrigin() int {
+	if biasTape {
+		return memorySize / 2
+	}
+	return 0
+}
+
+// newTape allocates a tape of memorySize cells, all set to the -fill value,
+// and then loads the -tape file into it, one byte per cell from the origin
+func newTape() []uint32 {
+	var cells = make([]uint32, memorySize)
+	var origin = tapeOrigin()
+	if fillValue != 0 {
+		for i := range cells {
+			cells[i] = uint32(fillValue)
 		}
+	} else if len(tapeData) > 0 {
+		setExtent(cells, origin+len(tapeData)-1)
+	} else {
+		setExtent(cells, origin)
 	}
+	for i, b := range tapeData {
+		cells[origin+i] = uint32(b)
+	}
+	return cells
 }
 
+// repeatBuffer is reused by writeRepeated so printing a run of characters
+// doesn't allocate. Longer runs are written in chunks of repeatChunk bytes.
+var repeatBuffer []byte
+
+const repeatChunk = 4096
+
+// writeRepeated writes c to the output count times
+func writeRepeated(c byte, count int) {
+	if count == 1 {
+		output.WriteByte(c)
+		return
+	}
+	var size = count
+	if size > repeatChunk {
+		size = repeatChunk
+	}
+	if cap(repeatBuffer) < size {
+		repeatBuffer = make([]byte, size)
+	}
+	var run = repeatBuffer[:size]
+	run[0] = c
+	for filled := 1; filled < size; filled *= 2 {
+		copy(run[filled:], run[:filled])
+	}
+	for ; count > size; count -= size {
+		output.Write(run)
+	}
+	output.Write(run[:count])
+}
+
+// wrapIndex maps any index onto a tape of the given length
+func wrapIndex(index int, length int) int {
+	return (index%length + length) % length
+}
+
+// fold counts the run of char starting at index *i and leaves *i on the last
+// character of the run
 func fold(code *string, i *int, char byte) int {
 	var count = 1
-	for *i < stringLength-1 && (*code)[*i+1] == char {
+	for *i+1 < len(*code) && (*code)[*i+1] == char {
 		count++
 		*i++
 	}
@@ -90,300 +392,1643 @@ func processBalanced(s string, char1 string, char2 string) string {
 func parseMessage(code string, message string, msgType byte) {
 	switch msgType {
 	case Info:
-		colorstring.Print("[blue]INFO:[default] ")
+		colorstring.Fprint(diagnostics, "[blue]INFO:[default] ")
 	case Warning:
-		colorstring.Print("[yellow]WARNING:[default] ")
+		colorstring.Fprint(diagnostics, "[yellow]WARNING:[default] ")
 	case Error:
-		colorstring.Print("[red]ERROR:[default] ")
+		colorstring.Fprint(diagnostics, "[red]ERROR:[default] ")
 	}
-	fmt.Println(message)
+	fmt.Fprintln(diagnostics, message)
 }
 
-func dumpMem(cells *[]byte, cellptr *int) {
+// Cells after tapeExtent on the tape whose first cell is extentTape are known
+// to be zero, as no program has touched them since the tape was made. This
+// saves usedCells from searching the whole tape for the last non-zero cell.
+var extentTape *uint32
+var tapeExtent int
+
+// knownExtent returns the last cell of the tape that may not be zero
+func knownExtent(cells []uint32) int {
+	if len(cells) > 0 && extentTape == &cells[0] {
+		return tapeExtent
+	}
+	return len(cells) - 1
+}
+
+// setExtent records that every cell of the tape after extent is zero
+func setExtent(cells []uint32, extent int) {
+	if len(cells) > 0 {
+		extentTape = &cells[0]
+		tapeExtent = extent
+	}
+}
+
+// usedCells returns how many cells from the start of the tape are worth
+// showing: up to the last non-zero cell or the pointer, whichever is further
+func usedCells(cells *[]uint32, cellptr *int) int {
 	var lastNonEmpty = 0
-	for x := len(*cells) - 1; x > 0; x-- {
+	for x := knownExtent(*cells); x > 0; x-- {
 		if (*cells)[x] != 0 {
 			lastNonEmpty = x
 			break
 		}
 	}
-	fmt.Println("         000 001 002 003 004 005 006 007 008 009")
-	var row = 0
-	for x := 0; x <= int(math.Max(float64(lastNonEmpty), float64(*cellptr))); x++ {
-		if x%10 == 0 {
-			if row != 0 {
-				fmt.Print("\n")
+	return int(math.Max(float64(lastNonEmpty), float64(*cellptr))) + 1
+}
+
+// cellValue is a cell as shown to the user, as a two's complement number of
+// -cellsize bits with -signed
+func cellValue(value uint32) int64 {
+	if signedCells && value > cellMask>>1 {
+		return int64(value) - int64(cellMask) - 1
+	}
+	return int64(value)
+}
+
+func dumpMem(cells *[]uint32, cellptr *int) {
+	if sparseDump {
+		dumpSparse(cells, cellptr)
+		return
+	}
+	var used = usedCells(cells, cellptr)
+	var origin = tapeOrigin()
+	// Rows are numbered from the origin, a biased tape starts at the first
+	// row with anything to show
+	var first = 0
+	if origin > 0 {
+		first = *cellptr
+		for x := 0; x < first; x++ {
+			if (*cells)[x] != 0 {
+				first = x
 			}
-			fmt.Print(row, strings.Repeat(" ", 9-len(fmt.Sprint(row))))
-			row = row + 10
 		}
+		first -= wrapIndex(first-origin, 10)
+		if first < 0 {
+			first = 0
+		}
+	}
+	var width = len(fmt.Sprint(cellMask)) + 1
+	if signedCells {
+		width = len(fmt.Sprint(cellValue(cellMask>>1+1))) + 1
+	}
+	fmt.Fprint(diagnostics, "        ")
+	for x := 0; x < 10; x++ {
+		fmt.Fprintf(diagnostics, " %0*d", width-1, x)
+	}
+	fmt.Fprintln(diagnostics)
+	for x := first; x < used; x++ {
+		if (x-first)%10 == 0 {
+			if x != first {
+				fmt.Fprint(diagnostics, "\n")
+			}
+			var row = fmt.Sprint(x - origin)
+			fmt.Fprint(diagnostics, row, strings.Repeat(" ", 9-len(row)))
+		}
+		var value = cellValue((*cells)[x])
 		if x == *cellptr {
-			colorstring.Printf("[green]%d[default]%s", (*cells)[x], strings.Repeat(" ", 4-len(fmt.Sprint((*cells)[x]))))
+			colorstring.Fprintf(diagnostics, "[green]%d[default]%s", value, strings.Repeat(" ", width-len(fmt.Sprint(value))))
 		} else {
-			fmt.Print((*cells)[x], strings.Repeat(" ", 4-len(fmt.Sprint((*cells)[x]))))
+			fmt.Fprint(diagnostics, value, strings.Repeat(" ", width-len(fmt.Sprint(value))))
 		}
 	}
-	fmt.Println("")
+	fmt.Fprintln(diagnostics)
 }
 
-func compile(code *string) (*[]Instruction, bool) {
-	defer elapsed(0)()
-	//* Optimize
+// dumpSparse prints only the non-zero cells, one index: value pair per line,
+// highlighting the one the pointer is on
+func dumpSparse(cells *[]uint32, cellptr *int) {
+	var origin = tapeOrigin()
+	var printed = false
+	for x := 0; x <= knownExtent(*cells); x++ {
+		if (*cells)[x] == 0 {
+			continue
+		}
+		printed = true
+		if x == *cellptr {
+			colorstring.Fprintf(diagnostics, "%d: [green]%d[default]\n", x-origin, cellValue((*cells)[x]))
+		} else {
+			fmt.Fprintf(diagnostics, "%d: %d\n", x-origin, cellValue((*cells)[x]))
+		}
+	}
+	if !printed {
+		fmt.Fprintln(diagnostics, "All cells are zero")
+	}
+}
+
+// countTokens counts the bytes of s that appear in tokens
+func countTokens(s string, tokens string) int {
+	var count = 0
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(tokens, s[i]) != -1 {
+			count++
+		}
+	}
+	return count
+}
+
+// insertInts inserts value into s at index
+func insertInts(s []int, index int, value int) []int {
+	s = append(s, 0)
+	copy(s[index+1:], s[index:])
+	s[index] = value
+	return s
+}
+
+// replaceInOrder works like ReplaceAllStringFunc, but also tells replace how
+// many of the given tokens precede the match in the result. Optimizer passes
+// use it to keep loop operands in the same order as their tokens, even when a
+// later pass creates a token in front of existing ones.
+func replaceInOrder(code string, re *regexp.Regexp, tokens string, replace func(match string, preceding int) string) string {
+	var result strings.Builder
+	var last = 0
+	var preceding = 0
+	for _, match := range re.FindAllStringIndex(code, -1) {
+		preceding += countTokens(code[last:match[0]], tokens)
+		var replacement = replace(code[match[0]:match[1]], preceding)
+		preceding += countTokens(replacement, tokens)
+		result.WriteString(code[last:match[0]])
+		result.WriteString(replacement)
+		last = match[1]
+	}
+	result.WriteString(code[last:])
+	return result.String()
+}
+
+// copyloopIndex returns the index in counts of the copy loop that comes after
+// the given number of P tokens
+func copyloopIndex(counts []int, preceding int) int {
+	var index = 0
+	for ; index < len(counts) && preceding > 0; index++ {
+		preceding -= counts[index]
+	}
+	return index
+}
+
+// Patterns used by Optimize, compiled once
+var (
+	dummyCharsRegex    = regexp.MustCompile(`[^\+\-\>\<\.\,\]\[]`)
+	dummyCharsAuxRegex = regexp.MustCompile(`[^\+\-\>\<\.\,\]\[\{\}\^_]`)
+	nopAddSubRegex     = regexp.MustCompile(`[+-]{2,}`)
+	nopRgtLftRegex     = regexp.MustCompile(`[><]{2,}`)
+	clearloopRegex     = regexp.MustCompile(`[C+-]*(?:\[(?:[+-]+|C)\])+\.*`) // Also delete any modifications to cell that is being cleared
+	clearloopIORegex   = regexp.MustCompile(`[C+-]*(?:\[(?:[+-]+|C)\])+`)    // The same, keeping prints when keepPrints says so
+	scanloopRegex      = regexp.MustCompile(`\[(?:>+|<+)\]`)
+	noClearRegex       = regexp.MustCompile(`([RLP])C`)
+	noPrintRegex       = regexp.MustCompile(`([CRLP])\.+`)
+	overwriteRegex     = regexp.MustCompile(`[-+C]+,`)
+	nopLoopRegex       = regexp.MustCompile(`(?:\[\])+`)
+	copyloopRegex      = regexp.MustCompile(`\[-(?:[<>]+\++)+[<>]+\]|\[(?:[<>]+\++)+[<>]+-\]`)
+	copyTargetRegex    = regexp.MustCompile(`[<>]+\++`)
+	riskyCodeRegex     = regexp.MustCompile(`,|\[[+-]+\]\.`) // Input and printing cleared cells, checked by -safecheck
+)
+
+// dummyCharsExtRegex matches everything but commands when hooks or banks add
+// commands of their own, and is nil otherwise. updateDummyChars builds it
+// whenever those change, so Optimize doesn't have to.
+var dummyCharsExtRegex *regexp.Regexp
+
+// updateDummyChars rebuilds dummyCharsExtRegex from the enabled extensions
+func updateDummyChars() {
+	dummyCharsExtRegex = nil
+	if len(hooks) == 0 && bankCount == 1 {
+		return
+	}
+	var class strings.Builder
+	for _, char := range []byte(commandChars()) {
+		fmt.Fprintf(&class, `\x%02x`, char)
+	}
+	dummyCharsExtRegex = regexp.MustCompile(`[^` + class.String() + `]`)
+}
+
+// LoopData holds the operands of the P (multiply-copy) and R/L (scan) tokens
+// produced by Optimize, in the order Compile consumes them. CopyCounts holds
+// the number of targets, and so of P tokens, of each copy loop, as the P tokens
+// of neighbouring copy loops run together.
+type LoopData struct {
+	CopyOffsets     []int
+	CopyMultipliers []int
+	ScanSteps       []int
+	CopyCounts      []int
+}
+
+// commandChars returns the characters that are commands, including those of
+// enabled extensions
+func commandChars() string {
+	var commands = "+-<>[].,"
+	if auxSize > 0 {
+		commands += "{}^_"
+	}
+	if bankCount > 1 {
+		commands += string(bankChar)
+	}
+	return commands + hookChars()
+}
+
+// Optimize strips comments from Brainfuck source and rewrites common idioms
+// into the intermediate tokens understood by Compile: C (clear cell),
+// R/L (scan right/left) and P (multiply-copy). Each copy loop becomes as many
+// P tokens as it has targets, counted in LoopData.CopyCounts, and leaves the
+// source cell cleared. Characters used by enabled
+// extensions are kept. The offset in code each token came from is returned
+// too, or nil when it isn't known.
+func Optimize(code string, passes int) (string, LoopData, []int) {
+	if regexOptimizer {
+		var optimized, loops = optimizeRegex(code, passes)
+		return optimized, loops, nil
+	}
+	return optimizeTokens(code, passes)
+}
+
+// keepPrints reports whether printing a cell that is known to be zero has to
+// be kept, because -no-optimize-io is given or the output mode doesn't write
+// a zero as a single NUL byte
+func keepPrints() bool {
+	return noOptimizeIO || decimalOutput || utf8Output || outputTable != nil || asciiWarn || asciiError
+}
+
+// optimizeRegex is the original optimizer, which rewrites the whole source with
+// a series of regular expressions on every pass. It's kept behind -regexopt to
+// cross-check optimizeTokens.
+func optimizeRegex(code string, passes int) (string, LoopData) {
+	return optimizeStages(code, passes, func(string, string) {})
+}
+
+// optimizeStages runs the regex optimizer, calling stage with a label and the
+// code after every step, for the explain command
+func optimizeStages(code string, passes int, stage func(label string, code string)) (string, LoopData) {
+	var loops = LoopData{make([]int, 0), make([]int, 0), make([]int, 0), make([]int, 0)}
+
 	// Remove useless characters
-	var dummyChars = regexp.MustCompile(`[^\+\-\>\<\.\,\]\[]`)
-	*code = dummyChars.ReplaceAllString(*code, "")
+	var dummyChars = dummyCharsRegex
+	if dummyCharsExtRegex != nil {
+		dummyChars = dummyCharsExtRegex
+	} else if auxSize > 0 {
+		dummyChars = dummyCharsAuxRegex
+	}
+	code = dummyChars.ReplaceAllString(code, "")
+	stage("Strip comments", code)
 
 	// Remove NOPs
-	var nopAddSub = regexp.MustCompile(`[+-]{2,}`)
-	var nopRgtLft = regexp.MustCompile(`[><]{2,}`)
-	*code = nopAddSub.ReplaceAllStringFunc(*code, func(s string) string { return processBalanced(s, "+", "-") })
-	*code = nopRgtLft.ReplaceAllStringFunc(*code, func(s string) string { return processBalanced(s, ">", "<") })
+	code = nopAddSubRegex.ReplaceAllStringFunc(code, func(s string) string { return processBalanced(s, "+", "-") })
+	code = nopRgtLftRegex.ReplaceAllStringFunc(code, func(s string) string { return processBalanced(s, ">", "<") })
+	stage("Fold NOPs", code)
 
-	var copyloopCounter int
-	var copyloopMap = make([]int, 0)
-	var copyloopMulMap = make([]int, 0)
-
-	var scanloopCounter int
-	var scanloopMap = make([]int, 0)
+	for z := 0; z < passes; z++ {
+		var pass = ""
+		if passes > 1 {
+			pass = fmt.Sprintf(" (pass %d)", z+1)
+		}
 
-	for z := 0; z < optPasses; z++ {
 		// Clearloop optimization
-		var clearloop = regexp.MustCompile(`[C+-]*(?:\[[+-]+\])+\.*`) // Also delete any modifications to cell that is being cleared
-		*code = clearloop.ReplaceAllString(*code, "C")
+		if keepPrints() {
+			code = clearloopIORegex.ReplaceAllString(code, "C")
+		} else {
+			code = clearloopRegex.ReplaceAllString(code, "C")
+		}
+		stage("Clear loops"+pass, code)
 
 		// Scanloop optimization
-		var scanloopRight = regexp.MustCompile(`\[>+\]`)
-		var scanloopLeft = regexp.MustCompile(`\[<+\]`)
-		*code = scanloopRight.ReplaceAllStringFunc(*code, func(s string) string {
-			scanloopMap = append(scanloopMap, strings.Count(s, ">"))
-			return "R"
-		})
-		*code = scanloopLeft.ReplaceAllStringFunc(*code, func(s string) string {
-			scanloopMap = append(scanloopMap, strings.Count(s, "<"))
+		code = replaceInOrder(code, scanloopRegex, "RL", func(s string, preceding int) string {
+			loops.ScanSteps = insertInts(loops.ScanSteps, preceding, len(s)-2)
+			if s[1] == '>' {
+				return "R"
+			}
 			return "L"
 		})
+		stage("Scan loops"+pass, code)
 
 		// Don't clear or print if cell is known zero
-		var noClearPrint = regexp.MustCompile(`[RL]+C|[CRL]+\.+`)
-		*code = noClearPrint.ReplaceAllString(*code, "")
-
-		// Don't update cells if they are immediately overwritten by stdin
-		var overwrite = regexp.MustCompile(`[+-C]+,`)
-		*code = overwrite.ReplaceAllString(*code, ",")
+		code = noClearRegex.ReplaceAllString(code, "$1")
+		if !keepPrints() {
+			code = noPrintRegex.ReplaceAllString(code, "$1")
+		}
+		if !noOptimizeIO {
+			// Don't update cells if they are immediately overwritten by stdin
+			code = overwriteRegex.ReplaceAllString(code, ",")
+		}
 
-		var nopLoop = regexp.MustCompile(`\[+\]+`)
-		*code = nopLoop.ReplaceAllString(*code, "")
+		code = nopLoopRegex.ReplaceAllString(code, "")
+		stage("Known zero cells"+pass, code)
 
 		// Multiloops/copyloops optimization
-		var copyloop = regexp.MustCompile(`\[-(?:[<>]+\++)+[<>]+\]|\[(?:[<>]+\++)+[<>]+-\]`)
-		*code = copyloop.ReplaceAllStringFunc(*code, func(s string) string {
+		code = replaceInOrder(code, copyloopRegex, "P", func(s string, preceding int) string {
 			var numOfCopies int = 0
 			var offset int = 0
 			if strings.Count(s, ">")-strings.Count(s, "<") == 0 {
-				var tempRegex = regexp.MustCompile(`[<>]+\++`)
-				for _, v := range tempRegex.FindAllString(s, -1) {
+				for _, v := range copyTargetRegex.FindAllString(s, -1) {
 					offset += -strings.Count(v, "<") + strings.Count(v, ">")
-					copyloopMap = append(copyloopMap, offset)
-					copyloopMulMap = append(copyloopMulMap, strings.Count(v, "+"))
+					loops.CopyOffsets = insertInts(loops.CopyOffsets, preceding+numOfCopies, offset)
+					loops.CopyMultipliers = insertInts(loops.CopyMultipliers, preceding+numOfCopies, strings.Count(v, "+"))
 					numOfCopies++
 				}
-				s1 := fmt.Sprintf("%sC", strings.Repeat("P", numOfCopies))
-				return s1
+				loops.CopyCounts = insertInts(loops.CopyCounts, copyloopIndex(loops.CopyCounts, preceding), numOfCopies)
+				return strings.Repeat("P", numOfCopies)
 			} else {
 				return s
 			}
 		})
+		stage("Copy loops"+pass, code)
 	}
 
+	return code, loops
+}
+
+// Options controls how Compile turns source code into a Program
+type Options struct {
+	OptPasses int    // Number of optimizer passes, 0 disables the optimizer
+	Level     int    // Optimization level, instructions are only merged and fused from 2 on
+	Size      bool   // Favour fewer instructions over speed
+	Source    string // Original source quoted in messages, if it differs from the code compiled
+}
+
+// Program is source code compiled into linked instructions, ready to be
+// executed any number of times
+type Program struct {
+	Instructions []Instruction
+	Code         string // Optimized source the instructions were compiled from
+	Source       string // Original source, with comments and formatting intact
+	Positions    []int  // Offset in Source of each instruction, nil if unknown
+}
+
+// Position returns the 1-based line and column in the source that the
+// instruction at pc was compiled from
+func (p *Program) Position(pc int) (line int, column int, ok bool) {
+	if pc < 0 || pc >= len(p.Positions) {
+		return 0, 0, false
+	}
+	line, column = sourcePosition(p.Source, p.Positions[pc])
+	return line, column, true
+}
+
+// sourcePosition returns the 1-based line and column of a byte offset in source
+func sourcePosition(source string, offset int) (line int, column int) {
+	var lineStart = strings.LastIndexByte(source[:offset], '\n') + 1
+	return strings.Count(source[:lineStart], "\n") + 1, offset - lineStart + 1
+}
+
+// locate adds the source position of the instruction at pc to err
+func (p *Program) locate(err error, pc int) error {
+	var vmErr *VMError
+	var breakpoint *breakpointError
+	if errors.As(err, &breakpoint) || !errors.As(err, &vmErr) {
+		return err
+	}
+	if line, column, ok := p.Position(pc); ok {
+		vmErr.Message += fmt.Sprintf(" at line %d, column %d%s", line, column, quoteSource(p.Source, line, column))
+	}
+	return err
+}
+
+// Compile optimizes code and compiles it into a Program, linking loops to
+// the absolute indices of their matching brackets
+func Compile(code string, opts Options) (*Program, error) {
+	defer elapsed(0)()
+	if opts.Source == "" {
+		opts.Source = code
+	}
+	if strictSource {
+		if err := checkStrict(code, opts.Source); err != nil {
+			return nil, err
+		}
+	}
+	if !lintOnly {
+		if err := checkEndlessLoops(code, opts.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	if safeCheck && opts.OptPasses > 0 && riskyCodeRegex.MatchString(dummyCharsRegex.ReplaceAllString(code, "")) {
+		parseMessage("", "Program reads input or prints cleared cells, running it unoptimized", Warning)
+		opts.OptPasses = 0
+	}
+
+	var loops LoopData
+	var origins []int
+	var optimized = elapsed(2)
+	code, loops, origins = Optimize(code, opts.OptPasses)
+	optimized()
+	var copyloopCounter int
+	var copyGroupCounter int
+	var copiesLeft int
+	var scanloopCounter int
+
 	// Compile & link loops
-	stringLength = len(*code)
-	var instructions = make([]Instruction, 0)
+	stringLength = len(code)
+	// Every token compiles to at most one instruction, except that each copy
+	// loop also gets a check and a clear, so this is always enough
+	var capacity = len(code) + 2*len(loops.CopyCounts)
+	var instructions = make([]Instruction, 0, capacity)
+	var positions = make([]int, 0, capacity)
 	var tBraceStack = make([]int, 0)
 	for i := 0; i < stringLength; i++ {
 		var newInstruction Instruction
-		switch (*code)[i] {
+		var position = -1
+		if origins != nil {
+			position = origins[i]
+		}
+		switch code[i] {
 		case '+':
-			newInstruction = Instruction{ADD_SUB, fold(code, &i, '+'), 0}
+			newInstruction = Instruction{ADD_SUB, fold(&code, &i, '+'), 0}
 		case '-':
-			newInstruction = Instruction{ADD_SUB, -fold(code, &i, '-'), 0}
+			newInstruction = Instruction{ADD_SUB, -fold(&code, &i, '-'), 0}
 		case '>':
-			newInstruction = Instruction{PTR_MOV, fold(code, &i, '>'), 0}
+			newInstruction = Instruction{PTR_MOV, fold(&code, &i, '>'), 0}
 		case '<':
-			newInstruction = Instruction{PTR_MOV, -fold(code, &i, '<'), 0}
+			newInstruction = Instruction{PTR_MOV, -fold(&code, &i, '<'), 0}
 		case '[':
 			tBraceStack = append(tBraceStack, len(instructions))
+			if maxDepth > 0 && len(tBraceStack) > maxDepth {
+				if position == -1 {
+					return nil, newError(ExitSyntax, "Loops nested more than %d deep (instruction %d)", maxDepth, len(instructions))
+				}
+				var line, column = sourcePosition(opts.Source, position)
+				return nil, newError(ExitSyntax, "Loops nested more than %d deep at line %d, column %d%s", maxDepth, line, column, quoteSource(opts.Source, line, column))
+			}
 			newInstruction = Instruction{JMP_ZER, 0, 0}
 		case ']':
 			if len(tBraceStack) == 0 {
-				parseMessage(*code, "Extra loop close bracket", Error)
-				return nil, true
+				return nil, newError(ExitSyntax, "Extra loop close bracket")
 			}
 			start := tBraceStack[len(tBraceStack)-1]
 			tBraceStack = tBraceStack[:len(tBraceStack)-1]
 			instructions[start].Data = len(instructions)
 			newInstruction = Instruction{JMP_NOT_ZER, start, 0}
 		case '.':
-			newInstruction = Instruction{PUT_CHR, fold(code, &i, '.'), 0}
+			newInstruction = Instruction{PUT_CHR, fold(&code, &i, '.'), 0}
 		case ',':
 			newInstruction = Instruction{RAD_CHR, 0, 0}
 		case 'C':
 			newInstruction = Instruction{CLR, 0, 0}
 		case 'P':
-			newInstruction = Instruction{MUL_CPY, copyloopMap[copyloopCounter], copyloopMulMap[copyloopCounter]}
+			// The copies of one copy loop are a group: a single check skips
+			// the whole group when the source is zero, so the copies
+			// themselves don't check, and the group ends by clearing the
+			// source. Copies of zero do nothing, so the check can go when size
+			// matters more. Neighbouring copy loops are told apart by
+			// CopyCounts, not by where the run of P tokens ends.
+			if copiesLeft == 0 {
+				copiesLeft = loops.CopyCounts[copyGroupCounter]
+				copyGroupCounter++
+				if !opts.Size {
+					instructions = append(instructions, Instruction{SKP_ZER, len(instructions) + copiesLeft + 1, 0})
+					positions = append(positions, position)
+				}
+			}
+			newInstruction = Instruction{MUL_CPY, loops.CopyOffsets[copyloopCounter], loops.CopyMultipliers[copyloopCounter]}
 			copyloopCounter++
-		case 'R':
-			newInstruction = Instruction{SCN_RGT, scanloopMap[scanloopCounter], 0}
-			scanloopCounter++
-		case 'L':
-			newInstruction = Instruction{SCN_LFT, scanloopMap[scanloopCounter], 0}
+			copiesLeft--
+			if copiesLeft == 0 {
+				instructions = append(instructions, newInstruction)
+				positions = append(positions, position)
+				newInstruction = Instruction{CLR, 0, 0}
+			}
+		case 'R', 'L':
+			var step = loops.ScanSteps[scanloopCounter]
+			if step <= 0 {
+				return nil, newError(ExitSyntax, "Scan with a step of %d (instruction %d)", step, len(instructions))
+			}
+			newInstruction = Instruction{SCN_RGT, step, 0}
+			if code[i] == 'L' {
+				newInstruction.Type = SCN_LFT
+			}
 			scanloopCounter++
+		case '}':
+			newInstruction = Instruction{AUX_MOV, fold(&code, &i, '}'), 0}
+		case '{':
+			newInstruction = Instruction{AUX_MOV, -fold(&code, &i, '{'), 0}
+		case '^':
+			newInstruction = Instruction{AUX_STR, 0, 0}
+		case '_':
+			newInstruction = Instruction{AUX_LOD, 0, 0}
+		case bankChar:
+			newInstruction = Instruction{BNK_NXT, 0, 0}
+		default:
+			newInstruction = Instruction{HOOK, int(code[i]), 0}
 		}
 		instructions = append(instructions, newInstruction)
+		positions = append(positions, position)
 	}
 
 	// *WIP*: Good error messages
-	if len(tBraceStack) != 0 {
-		for x := 0; x < len(tBraceStack); x++ {
-			parseMessage(*code, "Missing loop close bracket", Error)
-		}
-		return nil, true
+	if len(tBraceStack) == 1 {
+		return nil, newError(ExitSyntax, "Missing loop close bracket")
+	} else if len(tBraceStack) > 1 {
+		return nil, newError(ExitSyntax, "Missing %d loop close brackets", len(tBraceStack))
+	}
+	if opts.OptPasses > 0 && opts.Level >= 2 {
+		instructions, positions = peephole(instructions, positions)
+	}
+	if origins == nil {
+		positions = nil
 	}
 
-	return &instructions, false
+	return &Program{instructions, code, opts.Source, positions}, nil
 }
 
-func execute(cells *[]byte, cellptr *int, code *string) {
-	var instructions, err = compile(code)
-	if err {
-		return
-	}
+// maxCellError reports a write above -maxcell
+func maxCellError(cell int, value uint32, pc int) error {
+	return newError(ExitRuntime, "Cell %d was set to %d, above -maxcell %d (instruction %d)", cell, value, maxCell, pc)
+}
 
-	if trackStatistics {
-		defer printStatistics()
-	}
+// jitAllowed reports whether Exec may use the JIT. Features that have to see
+// every instruction as it runs need the interpreter.
+func jitAllowed() bool {
+	return useJIT && !trace && maxCell == 0 && !stepCount && len(watchCells) == 0 && breakCell < 0 && !showProgress
+}
 
-	defer elapsed(1)()
+// machine is a compiled program together with the tape it runs on. run can
+// execute a bounded number of instructions, which lets the debugger drive
+// execution one instruction at a time.
+type machine struct {
+	program      *Program
+	instructions []Instruction
+	cells        *[]uint32
+	cellptr      *int
+	pc           int
+	asciiWarned  bool // Whether -ascii-only warn already reported a character
+}
 
-	instructionCount = 0
-	optInstructionCount = 0
-	var waitTime time.Time
-	var instructionLength = len(*instructions)
-	for i := 0; i < instructionLength; i++ {
+func (m *machine) finished() bool {
+	return m.pc >= len(m.instructions)
+}
+
+// run executes at most steps instructions, or until the program ends if steps
+// is negative
+func (m *machine) run(steps int) error {
+	var cells = m.cells
+	var cellptr = m.cellptr
+	var instructions = m.instructions
+	var instructionLength = len(instructions)
+	var i = m.pc
+	var wrap = wrapPointer
+	var mask = cellMask
+	var maxValue = uint32(maxCell)
+	var watching = len(watchCells) > 0
+	var breaking = breakCell >= 0
+	var reporting = showProgress
+	// The furthest cell the program could have written to
+	var highest = knownExtent(*cells)
+	if *cellptr > highest {
+		highest = *cellptr
+	}
+	defer func() { setExtent(*cells, highest) }()
+
+	for ; i < instructionLength && steps != 0; i++ {
 		var currentCell = &(*cells)[*cellptr]
-		var currentInstruction = (*instructions)[i]
+		var currentInstruction = instructions[i]
+		var pc = i
+		var written = -1
+		var writtenValue uint32
+		if watching || breaking {
+			if written = writtenCell(*cells, *cellptr, currentInstruction); written != -1 {
+				writtenValue = (*cells)[written]
+			}
+		}
 
 		switch currentInstruction.Type {
 		case ADD_SUB:
-			*currentCell = byte(int(*currentCell) + currentInstruction.Data)
+			*currentCell = (*currentCell + uint32(currentInstruction.Data)) & mask
+			if maxValue != 0 && *currentCell > maxValue {
+				m.pc = i
+				return maxCellError(*cellptr, *currentCell, i)
+			}
 		case PTR_MOV:
-			*cellptr += currentInstruction.Data
+			if wrap {
+				*cellptr = wrapIndex(*cellptr+currentInstruction.Data, len(*cells))
+			} else if *cellptr+currentInstruction.Data < 0 || *cellptr+currentInstruction.Data >= len(*cells) {
+				m.pc = i
+				return newError(ExitRuntime, "Pointer moved out of the tape from cell %d to cell %d (instruction %d)", *cellptr, *cellptr+currentInstruction.Data, i)
+			} else {
+				*cellptr += currentInstruction.Data
+			}
+			if *cellptr > highest {
+				highest = *cellptr
+			}
 		case JMP_ZER:
 			if *currentCell == 0 {
 				i = currentInstruction.Data
 			}
 		case JMP_NOT_ZER:
 			if *currentCell != 0 {
+				if atomic.LoadInt32(&interrupted) != 0 {
+					m.pc = i
+					return newError(ExitInterrupt, "Interrupted (instruction %d)", i)
+				}
 				i = currentInstruction.Data
 			}
 		case PUT_CHR:
-			fmt.Print(strings.Repeat(string(*currentCell), currentInstruction.Data))
+			if (asciiWarn || asciiError) && !decimalOutput {
+				var printed = *currentCell
+				if !utf8Output {
+					printed &= 0xFF
+				}
+				if !isPrintableASCII(printed) {
+					if asciiError {
+						m.pc = i
+						return newError(ExitRuntime, "Non-printable character %d written by cell %d (instruction %d)", printed, *cellptr, i)
+					} else if !m.asciiWarned {
+						m.asciiWarned = true
+						output.Flush()
+						parseMessage("", fmt.Sprintf("Non-printable character %d written by cell %d (instruction %d), further ones are not reported", printed, *cellptr, i), Warning)
+					}
+				}
+			}
+			if decimalOutput {
+				for n := 0; n < currentInstruction.Data; n++ {
+					output.WriteString(strconv.FormatInt(cellValue(*currentCell), 10))
+					output.WriteByte(' ')
+				}
+			} else if utf8Output {
+				for n := 0; n < currentInstruction.Data; n++ {
+					output.WriteRune(rune(*currentCell))
+				}
+			} else if outputTable != nil {
+				writeRepeated(outputTable[byte(*currentCell)], currentInstruction.Data)
+			} else {
+				writeRepeated(byte(*currentCell), currentInstruction.Data)
+			}
+			if flushChars || flushLines && byte(*currentCell) == '\n' {
+				output.Flush()
+			}
 		case RAD_CHR:
-			// TODO: Fix this
-			var b = make([]byte, 1)
-			waitTime = time.Now()
-			os.Stdin.Read(b)
+			output.Flush()
+			var waitTime = time.Now()
+			var b, readErr = programInput.ReadByte()
 			ioWait = ioWait + time.Since(waitTime)
-			*currentCell = b[0]
+			*currentCell = uint32(b)
+			if maxValue != 0 && *currentCell > maxValue {
+				m.pc = i
+				return maxCellError(*cellptr, *currentCell, i)
+			}
+			if readErr == nil {
+				bytesRead++
+				if echoInput {
+					output.WriteByte(b)
+				}
+			}
 		case CLR:
 			optInstructionCount++
 			*currentCell = 0
+		case SET_VAL:
+			optInstructionCount++
+			*currentCell = uint32(currentInstruction.Data)
+			if maxValue != 0 && *currentCell > maxValue {
+				m.pc = i
+				return maxCellError(*cellptr, *currentCell, i)
+			}
+		case SKP_ZER:
+			optInstructionCount++
+			if *currentCell == 0 {
+				i = currentInstruction.Data
+			}
 		case MUL_CPY:
 			optInstructionCount++
-			if *currentCell != 0 {
-				(*cells)[*cellptr+currentInstruction.Data] = byte(int((*cells)[*cellptr+currentInstruction.Data]) + int(*currentCell)*currentInstruction.AuxData)
+			if *currentCell == 0 {
+				break
+			}
+			var target = *cellptr + currentInstruction.Data
+			if wrap {
+				target = wrapIndex(target, len(*cells))
+			} else if target < 0 || target >= len(*cells) {
+				m.pc = i
+				return newError(ExitRuntime, "Copy loop at cell %d wrote out of the tape to cell %d (instruction %d)", *cellptr, target, i)
+			}
+			if target > highest {
+				highest = target
+			}
+			(*cells)[target] = ((*cells)[target] + *currentCell*uint32(currentInstruction.AuxData)) & mask
+			if maxValue != 0 && (*cells)[target] > maxValue {
+				m.pc = i
+				return maxCellError(target, (*cells)[target], i)
 			}
 		case SCN_RGT:
 			optInstructionCount++
-			for ; *cellptr < memorySize && (*cells)[*cellptr] != 0; *cellptr += currentInstruction.Data {
+			var start = *cellptr
+			if currentInstruction.Data <= 0 && *currentCell != 0 {
+				m.pc = i
+				return newError(ExitRuntime, "Scan with a step of %d would never move (instruction %d)", currentInstruction.Data, i)
+			}
+			for (*cells)[*cellptr] != 0 {
+				if wrap {
+					*cellptr = wrapIndex(*cellptr+currentInstruction.Data, len(*cells))
+					if *cellptr == start {
+						m.pc = i
+						return newError(ExitRuntime, "Right scan found no zero cell starting from cell %d (instruction %d)", start, i)
+					}
+				} else if *cellptr+currentInstruction.Data >= len(*cells) {
+					m.pc = i
+					return newError(ExitRuntime, "Right scan ran off the end of the tape at cell %d (instruction %d)", *cellptr, i)
+				} else {
+					*cellptr += currentInstruction.Data
+				}
+			}
+			if *cellptr > highest {
+				highest = *cellptr
 			}
 		case SCN_LFT:
 			optInstructionCount++
-			for ; *cellptr > 0 && (*cells)[*cellptr] != 0; *cellptr -= currentInstruction.Data {
+			var start = *cellptr
+			if currentInstruction.Data <= 0 && *currentCell != 0 {
+				m.pc = i
+				return newError(ExitRuntime, "Scan with a step of %d would never move (instruction %d)", currentInstruction.Data, i)
 			}
+			for (*cells)[*cellptr] != 0 {
+				if wrap {
+					*cellptr = wrapIndex(*cellptr-currentInstruction.Data, len(*cells))
+					if *cellptr == start {
+						m.pc = i
+						return newError(ExitRuntime, "Left scan found no zero cell starting from cell %d (instruction %d)", start, i)
+					}
+				} else if *cellptr-currentInstruction.Data < 0 {
+					m.pc = i
+					return newError(ExitRuntime, "Left scan ran off the start of the tape at cell %d (instruction %d)", *cellptr, i)
+				} else {
+					*cellptr -= currentInstruction.Data
+				}
+			}
+			if *cellptr > highest {
+				highest = *cellptr
+			}
+		case AUX_MOV:
+			auxCellptr = wrapIndex(auxCellptr+currentInstruction.Data, len(auxCells))
+		case AUX_STR:
+			auxCells[auxCellptr] = *currentCell
+		case AUX_LOD:
+			*currentCell = auxCells[auxCellptr]
+			if maxValue != 0 && *currentCell > maxValue {
+				m.pc = i
+				return maxCellError(*cellptr, *currentCell, i)
+			}
+		case BNK_NXT:
+			switchBank(cells, (activeBank+1)%len(banks))
+			// Nothing is known about the new bank
+			highest = len(*cells) - 1
+		case HOOK:
+			// A hook may write anywhere
+			highest = len(*cells) - 1
+			if err := runHook(byte(currentInstruction.Data), *cells, cellptr, i); err != nil {
+				m.pc = i
+				return err
+			}
+		}
+		if trace && instructionCount >= traceFrom && (traceTo == 0 || instructionCount < traceTo) {
+			traceInstruction(m, pc, currentInstruction)
+		}
+		if written != -1 && isWatched(written) {
+			fmt.Fprintf(diagnostics, "Cell %d: %d -> %d (instruction %d, %s)\n", written, cellValue(writtenValue), cellValue((*cells)[written]), pc, instructionNames[currentInstruction.Type])
+		}
+		if breaking && written == breakCell && (*cells)[written] == breakValue {
+			instructionCount++
+			m.pc = i + 1
+			return &breakpointError{newError(ExitRuntime, "Cell %d reached %d (instruction %d)", written, breakValue, pc).(*VMError), m}
 		}
 		instructionCount++
+		if reporting && instructionCount&progressMask == 0 {
+			reportProgress()
+		}
+		steps--
 	}
+	m.pc = i
+
+	return nil
 }
 
-func printStatistics() {
+// Exec runs the program on the given tape, starting at the given cell
+func (p *Program) Exec(cells *[]uint32, cellptr *int) (err error) {
+	if trackStatistics {
+		defer printStatistics(p)
+	}
+	if stepCount {
+		defer func() { fmt.Fprintf(diagnostics, "\nSteps: %d\n", instructionCount) }()
+	}
+
+	defer output.Flush()
+	defer elapsed(1)()
+	if showProgress {
+		progressStart = time.Now()
+		progressShown = progressStart
+		defer finishProgress()
+	}
+
+	atomic.StoreInt32(&interrupted, 0)
+	atomic.StoreInt32(&running, 1)
+	defer atomic.StoreInt32(&running, 0)
+
+	instructionCount = 0
+	optInstructionCount = 0
+	ioWait = 0
+	if bankCount > 1 {
+		startBanks(*cells)
+		defer func() {
+			// The debugger carries on from a breakpoint in the bank it was in
+			var breakpoint *breakpointError
+			if !errors.As(err, &breakpoint) {
+				switchBank(cells, 0)
+			}
+		}()
+	}
+	var vm = machine{program: p, instructions: p.Instructions, cells: cells, cellptr: cellptr}
+	if jitAllowed() {
+		// Generated code doesn't track which cells it touches
+		defer setExtent(*cells, len(*cells)-1)
+		return p.locate(runJIT(&vm), vm.pc)
+	}
+	return p.locate(vm.run(-1), vm.pc)
+}
+
+// RunOn compiles code and runs it on a tape owned by the caller, starting at
+// *cellptr. The tape is modified in place and *cellptr is left where the
+// program stopped, so state carries over between calls, like in the REPL.
+// It's exported with Compile and Exec as the embedding API, which stays in
+// package main until the VM moves to a package of its own that can be
+// imported.
+func RunOn(cells []uint32, cellptr *int, code string, opts Options) error {
+	var program, err = Compile(code, opts)
+	if err != nil {
+		return err
+	}
+	return program.Exec(&cells, cellptr)
+}
+
+// captureRun calls run with , reading from input and the program output going
+// to a buffer instead of stdout, returning what was printed. The input and
+// output in use before are restored afterwards.
+func captureRun(input io.Reader, run func()) []byte {
+	var buffer bytes.Buffer
+	var savedOutput, savedInput = output, programInput
+	output = bufio.NewWriter(&buffer)
+	programInput = bufio.NewReader(input)
+	defer func() { output, programInput = savedOutput, savedInput }()
+
+	run()
+	output.Flush()
+	return buffer.Bytes()
+}
+
+// writtenCell returns the cell instruction writes to when run with the pointer
+// on cellptr, or -1 if it doesn't write to the tape or would fail
+func writtenCell(cells []uint32, cellptr int, instruction Instruction) int {
+	switch instruction.Type {
+	case ADD_SUB, CLR, SET_VAL, RAD_CHR, AUX_LOD:
+		return cellptr
+	case MUL_CPY:
+		var target = cellptr + instruction.Data
+		if wrapPointer {
+			return wrapIndex(target, len(cells))
+		} else if target >= 0 && target < len(cells) {
+			return target
+		}
+	}
+	return -1
+}
+
+// isWatched reports whether cell was given with -watch
+func isWatched(cell int) bool {
+	for _, watched := range watchCells {
+		if cell == watched {
+			return true
+		}
+	}
+	return false
+}
+
+// traceInstruction logs an instruction that was just executed along with the
+// cell it affected, that cell's new value and where the instruction came from
+func traceInstruction(m *machine, pc int, instruction Instruction) {
+	var cells = *m.cells
+	var cell = *m.cellptr
+	if instruction.Type == MUL_CPY {
+		cell = wrapIndex(cell+instruction.Data, len(cells))
+	}
+	fmt.Fprintf(diagnostics, "%6d %-11s %5d  [%d]=%d", pc, instructionNames[instruction.Type], instruction.Data, cell, cellValue(cells[cell]))
+	if line, column, ok := m.program.Position(pc); ok {
+		fmt.Fprintf(diagnostics, "  %d:%d", line, column)
+	}
+	fmt.Fprintln(diagnostics)
+}
+
+// -progress checks the clock every progressMask+1 steps and prints a line at
+// most every progressInterval
+const progressMask = 1<<20 - 1
+const progressInterval = 250 * time.Millisecond
+
+var progressStart time.Time
+var progressShown time.Time
+
+// reportProgress rewrites the progress line on stderr with the steps taken
+// and the time spent so far, unless it was updated very recently
+func reportProgress() {
+	if time.Since(progressShown) < progressInterval {
+		return
+	}
+	progressShown = time.Now()
+	fmt.Fprintf(diagnostics, "\rSteps: %d, elapsed: %s", instructionCount, progressShown.Sub(progressStart).Round(time.Millisecond))
+}
+
+// finishProgress ends the progress line, if one was printed
+func finishProgress() {
+	if progressShown != progressStart {
+		fmt.Fprintln(diagnostics)
+	}
+}
+
+// statisticsReport is what -s -json prints for a run. Times are in
+// nanoseconds. Steps counts the instructions executed and
+// compiled_instructions the instructions of the compiled program by type.
+type statisticsReport struct {
+	Steps                int            `json:"steps"`
+	OptimizedSteps       int            `json:"optimized_steps"`
+	CodeLength           int            `json:"code_length"`
+	CompiledInstructions map[string]int `json:"compiled_instructions"`
+	TotalTime            int64          `json:"total_ns"`
+	OptimizerTime        int64          `json:"optimizer_ns"`
+	CompilerTime         int64          `json:"compiler_ns"`
+	VMTime               int64          `json:"vm_ns"`
+	IOWait               int64          `json:"io_wait_ns"`
+}
+
+func printStatistics(p *Program) {
+	if jsonStatistics {
+		var report = statisticsReport{
+			Steps:                instructionCount,
+			OptimizedSteps:       optInstructionCount,
+			CodeLength:           stringLength,
+			CompiledInstructions: map[string]int{},
+			TotalTime:            int64(preprocessorTime + interpreterTime + ioWait),
+			OptimizerTime:        int64(optimizerTime),
+			CompilerTime:         int64(preprocessorTime - optimizerTime),
+			VMTime:               int64(interpreterTime),
+			IOWait:               int64(ioWait),
+		}
+		for _, instruction := range p.Instructions {
+			report.CompiledInstructions[instructionNames[instruction.Type]]++
+		}
+		var data, _ = json.Marshal(report)
+		fmt.Fprintf(statsOutput, "%s\n", data)
+		return
+	}
+
 	var interpreterTimeString = strings.ReplaceAll(interpreterTime.String(), "0s", "<1ns")
-	var preprocessorTimeString = strings.ReplaceAll(preprocessorTime.String(), "0s", "<1ns")
+	var optimizerTimeString = strings.ReplaceAll(optimizerTime.String(), "0s", "<1ns")
+	var compilerTimeString = strings.ReplaceAll((preprocessorTime - optimizerTime).String(), "0s", "<1ns")
 	var ioTimeString = strings.ReplaceAll(ioWait.String(), "0s", "<1ns")
 	var totalTimeString = strings.ReplaceAll((preprocessorTime + interpreterTime + ioWait).String(), "0s", "<1ns")
 
-	fmt.Printf("\nInstructions executed: %d (optimized: %d, optimized plaintext length: %d)\n", instructionCount, optInstructionCount, stringLength)
-	fmt.Printf("Execution time: %s (VM: %s, compiler: %s) (IO wait: %s)\n", totalTimeString, interpreterTimeString, preprocessorTimeString, ioTimeString)
+	fmt.Fprintf(statsOutput, "\nInstructions executed: %d (optimized: %d, optimized plaintext length: %d, compiled instructions: %d)\n", instructionCount, optInstructionCount, stringLength, len(p.Instructions))
+	fmt.Fprintf(statsOutput, "Execution time: %s (optimizer: %s, compiler: %s, VM: %s) (IO wait: %s)\n", totalTimeString, optimizerTimeString, compilerTimeString, interpreterTimeString, ioTimeString)
+	if instructionCount > 0 {
+		var perInstruction = float64(interpreterTime) / float64(instructionCount)
+		fmt.Fprintf(statsOutput, "VM time per instruction: %.2fns\n", perInstruction)
+	}
+}
+
+func usage() {
+	var out = flag.CommandLine.Output()
+	fmt.Fprintln(out, "Goof - an optimizing bf VM written in Go")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Usage:")
+	fmt.Fprintln(out, "  goof [flags] [file...]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Files given with -i or as arguments run one after another, each on a")
+	fmt.Fprintln(out, "fresh tape. Without any files, goof starts an interactive REPL that executes each line")
+	fmt.Fprintln(out, "against a persistent tape.")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Flags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Examples:")
+	fmt.Fprintln(out, "  goof -i hello.bf          run hello.bf")
+	fmt.Fprintln(out, "  goof -i prog.bf -s -dm    run prog.bf, print statistics and dump memory")
+	fmt.Fprintln(out, "  goof tests/*.bf           run every program in tests/")
+	fmt.Fprintln(out, "  goof                      start the REPL")
+}
+
+// savedCells returns the part of the tape the -dmfile and -tapeout files hold:
+// from the origin up to the last non-zero cell or the pointer. Cells left of
+// the origin are left out, so the files read the same with and without
+// -biastape.
+func savedCells(cells *[]uint32, cellptr *int) []uint32 {
+	var origin = tapeOrigin()
+	var end = usedCells(cells, cellptr)
+	if end < origin {
+		end = origin
+	}
+	return (*cells)[origin:end]
+}
+
+// writeMemFile exports the used part of the tape to a file, as CSV if the file
+// name ends in .csv and as JSON otherwise. Cells and the pointer are numbered
+// from the origin.
+func writeMemFile(filename string, cells *[]uint32, cellptr *int) error {
+	var used = savedCells(cells, cellptr)
+	var pointer = *cellptr - tapeOrigin()
+	var data []byte
+	if strings.HasSuffix(strings.ToLower(filename), ".csv") {
+		var builder strings.Builder
+		builder.WriteString("cell,value,pointer\n")
+		for x, value := range used {
+			var here = 0
+			if x == pointer {
+				here = 1
+			}
+			fmt.Fprintf(&builder, "%d,%d,%d\n", x, cellValue(value), here)
+		}
+		data = []byte(builder.String())
+	} else {
+		var values = make([]int64, len(used))
+		for x, value := range used {
+			values[x] = cellValue(value)
+		}
+		var dump = struct {
+			Pointer int     `json:"pointer"`
+			Cells   []int64 `json:"cells"`
+		}{pointer, values}
+		data, _ = json.Marshal(dump)
+		data = append(data, '\n')
+	}
+
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return &VMError{ExitIO, err.Error()}
+	}
+	return nil
+}
+
+// writeTapeFile writes the used part of the tape to a file, one byte per cell,
+// in the format -tape reads
+func writeTapeFile(filename string, cells *[]uint32, cellptr *int) error {
+	var used = savedCells(cells, cellptr)
+	var data = make([]byte, len(used))
+	for i, value := range used {
+		data[i] = byte(value)
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return &VMError{ExitIO, err.Error()}
+	}
+	return nil
+}
+
+// normalizeSource strips a leading UTF-8 byte order mark and converts CRLF
+// and lone CR line endings to LF, so positions in the source are counted the
+// same way no matter where a file was written
+func normalizeSource(code string) string {
+	code = strings.TrimPrefix(code, "\uFEFF")
+	code = strings.ReplaceAll(code, "\r\n", "\n")
+	return strings.ReplaceAll(code, "\r", "\n")
+}
+
+// isTerminal reports whether file is connected to a terminal
+func isTerminal(file *os.File) bool {
+	var info, err = file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// stripComments removes everything from a ; to the end of its line, keeping the
+// line breaks so positions in the rest of the source don't change
+func stripComments(code string) string {
+	var lines = strings.Split(code, "\n")
+	for i, line := range lines {
+		if start := strings.IndexByte(line, ';'); start != -1 {
+			lines[i] = line[:start]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reportFileError prints an error, naming the file when several files run
+func reportFileError(filename string, err error) {
+	if len(filenames) > 1 {
+		parseMessage("", filename+": "+err.Error(), Error)
+	} else {
+		parseMessage("", err.Error(), Error)
+	}
+}
+
+// lintFile reports suspicious constructs in a file and checks that it compiles
+// without running it
+func lintFile(filename string, code string, opts Options) error {
+	var warnings = lint(code)
+	for _, warning := range warnings {
+		parseMessage("", fmt.Sprintf("%s:%d:%d: %s", filename, warning.Line, warning.Column, warning.Message)+quoteSource(opts.Source, warning.Line, warning.Column), Warning)
+	}
+
+	var _, err = Compile(code, opts)
+	if err != nil {
+		reportFileError(filename, err)
+	} else if lintStrict && len(warnings) > 0 {
+		err = newError(ExitLint, "%s: %d lint warnings", filename, len(warnings))
+	}
+	return err
+}
+
+// runRepeated compiles code once and runs it -repeat times, each time on a
+// fresh tape, then reports the compile time and the spread of VM times. The
+// tape of the last run is left in cells.
+func runRepeated(code string, opts Options, cells *[]uint32, cellptr *int) error {
+	var program, err = Compile(code, opts)
+	if err != nil {
+		return err
+	}
+	var compileTime = preprocessorTime - optimizerTime
+
+	var statistics = trackStatistics
+	trackStatistics = false
+	defer func() { trackStatistics = statistics }()
+
+	var min, max, total time.Duration
+	for run := 0; run < repeatRuns; run++ {
+		*cells = newTape()
+		*cellptr = tapeOrigin()
+		auxCells = make([]uint32, auxSize)
+		auxCellptr = 0
+		resetBanks()
+		if err = program.Exec(cells, cellptr); err != nil {
+			return err
+		}
+		if run == 0 || interpreterTime < min {
+			min = interpreterTime
+		}
+		if interpreterTime > max {
+			max = interpreterTime
+		}
+		total += interpreterTime
+	}
+
+	fmt.Fprintf(diagnostics, "\nRuns: %d\n", repeatRuns)
+	fmt.Fprintf(diagnostics, "Optimizer time: %s, compiler time: %s\n", optimizerTime, compileTime)
+	fmt.Fprintf(diagnostics, "VM time: min %s, max %s, mean %s\n", min, max, total/time.Duration(repeatRuns))
+	return nil
+}
+
+// runFiltered compiles code once and runs it over and over on the same tape,
+// continuing where the pointer was left, for as long as there is input. It
+// stops at the end of input or after a run that read nothing, as running
+// again wouldn't read anything either.
+func runFiltered(code string, opts Options, cells *[]uint32, cellptr *int) error {
+	var program, err = Compile(code, opts)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var read = bytesRead
+		if err = program.Exec(cells, cellptr); err != nil {
+			return err
+		}
+		if bytesRead == read || atomic.LoadInt32(&interrupted) != 0 {
+			return nil
+		}
+		if _, err = programInput.Peek(1); err != nil {
+			return nil
+		}
+	}
+}
+
+// runFile executes a Brainfuck file on a fresh tape and reports any error
+func runFile(filename string) error {
+	var data, err = os.ReadFile(filename)
+	if err != nil {
+		err = &VMError{ExitIO, err.Error()}
+		reportFileError(filename, err)
+		return err
+	}
+
+	var code = normalizeSource(string(data))
+	if bangInput {
+		// Everything after the first ! is the program's input
+		if bang := strings.IndexByte(code, '!'); bang != -1 {
+			defer func(previous *bufio.Reader) { programInput = previous }(programInput)
+			programInput = bufio.NewReader(strings.NewReader(code[bang+1:]))
+			code = code[:bang]
+		}
+	}
+	var opts = Options{OptPasses: optPasses, Level: optLevel, Size: sizeOptimization, Source: code}
+	if semicolonComments {
+		code = stripComments(code)
+	}
+	if lintOnly {
+		return lintFile(filename, code, opts)
+	}
+	if emitFormat != "" {
+		return emitFile(filename, code, opts)
+	}
+	if estimateOnly {
+		return estimateFile(filename, code, opts)
+	}
+	if countOnly {
+		return countFile(filename, code, opts)
+	}
+
+	var cellptr = tapeOrigin()
+	var cells = newTape()
+	auxCells = make([]uint32, auxSize)
+	auxCellptr = 0
+	resetBanks()
+
+	if err = checkPointerUnderflow(code, opts.Source); err == nil {
+		if seededTape {
+			err = runSeeded(code, opts, &cells, &cellptr)
+		} else if repeatRuns > 1 {
+			err = runRepeated(code, opts, &cells, &cellptr)
+		} else if filterMode {
+			err = runFiltered(code, opts, &cells, &cellptr)
+		} else {
+			err = RunOn(cells, &cellptr, code, opts)
+		}
+	}
+	if err != nil {
+		reportFileError(filename, err)
+	}
+	fmt.Fprintln(diagnostics, "--------------------------------------------------------------------")
+	var breakpoint *breakpointError
+	if errors.As(err, &breakpoint) && !dumpMemory {
+		dumpMem(&cells, &cellptr)
+	}
+	if showPointer {
+		fmt.Fprintln(diagnostics, "Pointer:", cellptr-tapeOrigin())
+	}
+	if dumpMemory {
+		dumpMem(&cells, &cellptr)
+	}
+	if dumpMemoryFile != "" {
+		if dumpErr := writeMemFile(dumpMemoryFile, &cells, &cellptr); dumpErr != nil {
+			reportFileError(filename, dumpErr)
+			if err == nil {
+				err = dumpErr
+			}
+		}
+	}
+	if tapeOutFilename != "" {
+		if dumpErr := writeTapeFile(tapeOutFilename, &cells, &cellptr); dumpErr != nil {
+			reportFileError(filename, dumpErr)
+			if err == nil {
+				err = dumpErr
+			}
+		}
+	}
+	return err
 }
 
 func main() {
-	flag.StringVar(&filename, "i", "", "Brainfuck file to execute")
+	flag.Usage = usage
+	flag.Var(&filenames, "i", "Brainfuck file to execute (may be repeated)")
+	flag.StringVar(&outputFilename, "out", "", "Write program output to a file instead of stdout")
+	flag.BoolVar(&base64Output, "b64out", false, "Encode program output as base64, so binary output can be captured as text")
 	flag.IntVar(&memorySize, "m", 30_000, "Set tape size")
 	flag.IntVar(&optPasses, "o", 2, "Number of optimization passes")
+	flag.IntVar(&optLevel, "O", 2, "Optimization level: 0 (none), 1 (rewrite clear, scan and copy loops) or 2 (also merge neighbouring instructions and fuse clears with the additions after them)")
+	flag.Var(levelShorthand(0), "O0", "Shorthand for -O 0")
+	flag.Var(levelShorthand(1), "O1", "Shorthand for -O 1")
+	flag.Var(levelShorthand(2), "O2", "Shorthand for -O 2")
+	flag.BoolVar(&sizeOptimization, "Os", false, "Optimize for the fewest compiled instructions rather than speed, implies -O 2")
+	flag.BoolVar(&safeCheck, "safecheck", false, "Disable optimization for programs that read input or print cleared cells")
+	flag.IntVar(&rewindSteps, "rewind", 0, "Let the debugger step back through up to this many steps, remembering each one costs memory (0 disables stepping back)")
+	flag.Int64Var(&tapeSeed, "seed", 0, "Fill the tape with random values from this seed and check that the program behaves the same with and without the optimizer")
+	flag.BoolVar(&debugExtensions, "debugext", false, "Enable the debug commands # (dump memory), $ (print the pointer) and ? (print the current cell)")
+	flag.BoolVar(&bangInput, "bang", false, "Treat everything after the first ! in a file as the program's input")
+	flag.BoolVar(&noOptimizeIO, "no-optimize-io", false, "Keep every . and the changes to a cell right before , reads into it, leaving the other optimizations on")
+	flag.BoolVar(&regexOptimizer, "regexopt", false, "Use the older regex-based optimizer instead of the single-pass one")
 	flag.BoolVar(&trackStatistics, "s", false, "Track time taken and instruction count")
+	flag.BoolVar(&showProgress, "progress", false, "Show the steps taken and the time spent on stderr while a program runs (disables -jit)")
+	flag.BoolVar(&jsonStatistics, "json", false, "With -s, print statistics as one JSON object per run")
+	flag.StringVar(&statsFilename, "statsfile", "", "Write statistics to this file instead of stderr (implies -s)")
+	flag.BoolVar(&stepCount, "stepcount", false, "Print the number of instructions executed")
 	flag.BoolVar(&dumpMemory, "dm", false, "Dump memory after execution (doesn't do anything when starting to REPL mode)")
+	flag.BoolVar(&sparseDump, "dm-nonzero-only", false, "Dump only the non-zero cells, as index: value pairs, wherever memory is dumped")
+	flag.BoolVar(&biasTape, "biastape", false, "Start the pointer in the middle of the tape so programs can move left of where they start; dumps, -showptr and -tape count cells from there")
+	flag.BoolVar(&showPointer, "showptr", false, "Print the final pointer position after execution")
+	flag.StringVar(&dumpMemoryFile, "dmfile", "", "Write memory after execution to a file, as CSV if its name ends in .csv and JSON otherwise")
+
+	flag.Var(&watchCells, "watch", "Log every write to this cell (may be repeated)")
+	flag.StringVar(&breakWhen, "breakwhen", "", "Stop as soon as a cell is set to a value, given as cell=value, and show memory (the REPL opens the debugger instead)")
+	flag.BoolVar(&trace, "trace", false, "Log every executed instruction to stderr")
+	flag.IntVar(&traceFrom, "tracefrom", 0, "Only trace starting at the Nth executed instruction")
+	flag.IntVar(&traceTo, "traceto", 0, "Stop tracing at the Nth executed instruction (0 means no limit)")
+	flag.StringVar(&pointerMode, "ptr", "bounded", "Pointer movement past the tape ends: bounded (error) or wrap")
+	flag.IntVar(&cellSize, "cellsize", 8, "Cell width in bits: 8, 16 or 32")
+	flag.StringVar(&outputEncoding, "encoding", "byte", "Output encoding: byte (low byte of the cell) or utf8 (cell is a code point)")
+	flag.BoolVar(&decimalOutput, "numout", false, "Print cells as decimal numbers followed by a space instead of as characters (overrides -encoding)")
+	flag.BoolVar(&signedCells, "signed", false, "Show cells as signed numbers, e.g. 255 as -1 with 8-bit cells, in -numout output, memory dumps, the debugger and traces (arithmetic is unchanged)")
+	flag.BoolVar(&useJIT, "jit", false, "Compile programs to native code where supported (linux/amd64); instruction counts in statistics only cover interpreted instructions")
+	flag.StringVar(&inputString, "input", "", "Bytes for , to read instead of stdin; reading past the end behaves like EOF on stdin")
+	flag.StringVar(&inputFilename, "inputfile", "", "Read the bytes for , from this file instead of stdin, like -input")
+	flag.BoolVar(&echoInput, "echo", false, "Echo characters read by , to the output (ignored when stdin is a terminal, which echoes already)")
+	flag.IntVar(&outputBufferSize, "obuf", 4096, "Size of the program output buffer in bytes, output is written out whenever it fills up")
+	flag.StringVar(&flushMode, "flush", "line", "When to flush program output: char (after every character), line (after every newline) or none (only before input and at exit)")
+	flag.BoolVar(&filterMode, "filter", false, "Run each file again from the start on the same tape every time it ends, until input runs out or a run reads nothing")
+	flag.IntVar(&repeatRuns, "repeat", 1, "Compile each file once and run it this many times on a fresh tape, reporting min/max/mean VM time")
+	flag.IntVar(&maxDepth, "maxdepth", 0, "Refuse to compile programs with loops nested deeper than this, not counting loops the optimizer replaced (0 means no limit)")
+	flag.BoolVar(&strictSource, "strict", false, "Refuse to compile source with anything but commands and whitespace (comments are still allowed with -comments)")
+	flag.BoolVar(&semicolonComments, "comments", false, "Ignore everything from a ; to the end of the line, so comments may contain Brainfuck commands")
+	flag.BoolVar(&estimateOnly, "estimate", false, "Compile files and print instruction counts and a rough estimate of the steps they take instead of running them")
+	flag.BoolVar(&countOnly, "count", false, "Compile files and print how many instructions they compiled to instead of running them")
+	flag.StringVar(&emitFormat, "emit", "", "Compile files and write them out instead of running them: dot (Graphviz control flow graph), wasm (WebAssembly module importing putchar and getchar from env) or wat (the same module as text)")
+	flag.BoolVar(&lintOnly, "lint", false, "Check files for suspicious constructs and compile them without running")
+	flag.BoolVar(&lintStrict, "lint-strict", false, "With -lint, exit with status 6 if any warnings were found")
+	flag.BoolVar(&endlessLoopErrors, "endless-error", false, "Refuse to run programs with loops that can never terminate once entered instead of warning")
+	flag.UintVar(&maxCell, "maxcell", 0, "Stop with an error when a cell is set above this value, including by wrapping below zero (0 means no limit)")
+	flag.UintVar(&fillValue, "fill", 0, "Initial value of every tape cell")
+	flag.StringVar(&xlateFilename, "xlate", "", "Translate every output byte through this 256-byte file, which holds the byte to write for each value (byte encoding only)")
+	flag.StringVar(&tapeOutFilename, "tapeout", "", "Write the tape after execution to this file, one byte per cell from where the pointer started, up to the last non-zero cell or the pointer")
+	flag.StringVar(&tapeFilename, "tape", "", "Load the bytes of this file into the tape, one per cell starting where the pointer starts, before running")
+	flag.StringVar(&asciiOnly, "ascii-only", "", "Report output outside printable ASCII, newline and tab: warn (once per program) or error (stop the program)")
+	flag.IntVar(&auxSize, "aux", 0, "Enable the auxiliary scratch tape extension with this many cells")
+	flag.IntVar(&bankCount, "banks", 1, "Number of tape banks, with more than one @ switches to the next bank")
+	flag.BoolVar(&cellPrompt, "cellprompt", false, "Show the pointer and the value under it in the REPL prompt")
+	flag.BoolVar(&quiet, "quiet", false, "Print nothing but program output (errors included; check the exit status)")
+	flag.BoolVar(&selfTest, "selftest", false, "Run a few bundled programs with known output, with and without the optimizer, and report which pass")
+	flag.BoolVar(&printVersion, "version", false, "Print the version and exit")
+	flag.BoolVar(&printVersion, "v", false, "Shorthand for -version")
 
 	flag.Parse()
 
-	var cellptr = 0
-	var cells = make([]byte, memorySize)
+	if quiet {
+		diagnostics = io.Discard
+	}
+	statsOutput = diagnostics
+
+	if printVersion {
+		fmt.Println("goof version " + Version)
+		return
+	}
+
+	switch pointerMode {
+	case "bounded":
+	case "wrap":
+		wrapPointer = true
+	default:
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Unknown pointer mode "+pointerMode)
+		os.Exit(1)
+	}
+
+	switch cellSize {
+	case 8:
+		cellMask = 0xFF
+	case 16:
+		cellMask = 0xFFFF
+	case 32:
+		cellMask = 0xFFFFFFFF
+	default:
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Unsupported cell size "+fmt.Sprint(cellSize))
+		os.Exit(1)
+	}
+
+	if memorySize < 1 {
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] -m must be at least 1")
+		os.Exit(1)
+	} else if memorySize > largeTape {
+		colorstring.Fprintln(diagnostics, "[yellow]WARNING:[default] A tape of "+fmt.Sprint(memorySize)+" cells takes "+fmt.Sprint(memorySize*4>>20)+" MiB of memory")
+	}
+
+	if outputBufferSize < 1 {
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] -obuf must be at least 1")
+		os.Exit(1)
+	}
+
+	if optLevel < 0 || optLevel > 2 {
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Unknown optimization level "+fmt.Sprint(optLevel))
+		os.Exit(1)
+	}
+	if sizeOptimization {
+		optLevel = 2
+	}
+	if optLevel == 0 {
+		optPasses = 0
+	}
+
+	if rewindSteps < 0 {
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] -rewind can't be negative")
+		os.Exit(1)
+	}
+
+	if auxSize < 0 {
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] -aux can't be negative")
+		os.Exit(1)
+	}
+
+	if bankCount < 1 {
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] -banks must be at least 1")
+		os.Exit(1)
+	}
+
+	if maxDepth < 0 {
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] -maxdepth can't be negative")
+		os.Exit(1)
+	}
+
+	for _, cell := range watchCells {
+		if cell < 0 || cell >= memorySize {
+			colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Watched cell "+fmt.Sprint(cell)+" is not on the tape")
+			os.Exit(1)
+		}
+	}
+
+	if breakWhen != "" {
+		var value uint
+		if _, err := fmt.Sscanf(breakWhen, "%d=%d", &breakCell, &value); err != nil || breakCell < 0 || breakCell >= memorySize || value > uint(cellMask) {
+			colorstring.Fprintln(diagnostics, "[red]ERROR:[default] -breakwhen must be cell=value, with the cell on the tape and the value fitting in a cell")
+			os.Exit(1)
+		}
+		breakValue = uint32(value)
+	}
+
+	if repeatRuns < 1 {
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] -repeat must be at least 1")
+		os.Exit(1)
+	}
+
+	if xlateFilename != "" {
+		var table, err = os.ReadFile(xlateFilename)
+		if err != nil {
+			colorstring.Fprintln(diagnostics, "[red]ERROR:[default] "+err.Error())
+			os.Exit(ExitIO)
+		}
+		if len(table) != 256 {
+			colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Translation table "+xlateFilename+" has "+fmt.Sprint(len(table))+" bytes instead of 256")
+			os.Exit(1)
+		}
+		outputTable = new([256]byte)
+		copy(outputTable[:], table)
+	}
+
+	if tapeFilename != "" {
+		var err error
+		if tapeData, err = os.ReadFile(tapeFilename); err != nil {
+			colorstring.Fprintln(diagnostics, "[red]ERROR:[default] "+err.Error())
+			os.Exit(ExitIO)
+		}
+		if room := memorySize - tapeOrigin(); len(tapeData) > room {
+			colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Tape file "+tapeFilename+" has "+fmt.Sprint(len(tapeData))+" bytes, more than the "+fmt.Sprint(room)+" cells of the tape from where the pointer starts")
+			os.Exit(1)
+		}
+	}
+
+	if inputFilename != "" {
+		if inputString != "" {
+			colorstring.Fprintln(diagnostics, "[red]ERROR:[default] -input and -inputfile can't both be given")
+			os.Exit(1)
+		}
+		var data, err = os.ReadFile(inputFilename)
+		if err != nil {
+			colorstring.Fprintln(diagnostics, "[red]ERROR:[default] "+err.Error())
+			os.Exit(ExitIO)
+		}
+		inputString = string(data)
+	}
+
+	if fillValue > uint(cellMask) {
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Fill value "+fmt.Sprint(fillValue)+" doesn't fit in "+fmt.Sprint(cellSize)+"-bit cells")
+		os.Exit(1)
+	}
 
-	if filename != "" {
-		var data, err = os.ReadFile(filename)
-		if err == nil {
-			var code = string(data)
-			execute(&cells, &cellptr, &code)
-			fmt.Println("--------------------------------------------------------------------")
-			if dumpMemory {
-				dumpMem(&cells, &cellptr)
+	switch outputEncoding {
+	case "byte":
+	case "utf8":
+		utf8Output = true
+	default:
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Unknown output encoding "+outputEncoding)
+		os.Exit(1)
+	}
+
+	switch flushMode {
+	case "char":
+		flushChars = true
+	case "line":
+		flushLines = true
+	case "none":
+	default:
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Unknown flush mode "+flushMode)
+		os.Exit(1)
+	}
+
+	switch emitFormat {
+	case "", "dot", "wat", "wasm":
+	default:
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Unknown -emit format "+emitFormat)
+		os.Exit(1)
+	}
+
+	switch asciiOnly {
+	case "":
+	case "warn":
+		asciiWarn = true
+	case "error":
+		asciiError = true
+	default:
+		colorstring.Fprintln(diagnostics, "[red]ERROR:[default] Unknown -ascii-only mode "+asciiOnly)
+		os.Exit(1)
+	}
+
+	if debugExtensions {
+		registerDebugExtensions()
+	}
+	updateDummyChars()
+
+	if useJIT && !jitSupported {
+		parseMessage("", "-jit is not supported on this platform, using the interpreter", Warning)
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "input" || f.Name == "inputfile" {
+			programInput = bufio.NewReader(strings.NewReader(inputString))
+		}
+		if f.Name == "seed" {
+			seededTape = true
+		}
+	})
+
+	if echoInput && programInput == input && isTerminal(os.Stdin) {
+		echoInput = false
+	}
+
+	// Files are only created once every flag checked out, from here on goof
+	// leaves through exit, which closes them
+	if statsFilename != "" {
+		var file, err = os.Create(statsFilename)
+		if err != nil {
+			colorstring.Fprintln(diagnostics, "[red]ERROR:[default] "+err.Error())
+			os.Exit(ExitIO)
+		}
+		statsFile = file
+		statsOutput = file
+		trackStatistics = true
+	}
+	var destination io.Writer = os.Stdout
+	if outputFilename != "" {
+		var file, err = os.Create(outputFilename)
+		if err != nil {
+			colorstring.Fprintln(diagnostics, "[red]ERROR:[default] "+err.Error())
+			exit(ExitIO)
+		}
+		outputFile = file
+		destination = file
+	}
+	if base64Output {
+		outputEncoder = base64.NewEncoder(base64.StdEncoding, destination)
+		destination = outputEncoder
+	}
+	output = bufio.NewWriterSize(destination, outputBufferSize)
+
+	filenames = append(filenames, flag.Args()...)
+	handleInterrupts()
+
+	if selfTest {
+		var status = ExitOK
+		if err := selfTestAll(); err != nil {
+			parseMessage("", err.Error(), Error)
+			status = exitCode(err)
+		}
+		exit(status)
+	}
+
+	if len(filenames) > 0 {
+		var status = ExitOK
+		for _, filename := range filenames {
+			var err = runFile(filename)
+			if err != nil && status == ExitOK {
+				status = exitCode(err)
+			}
+			if exitCode(err) == ExitInterrupt {
+				break
 			}
-		} else {
-			colorstring.Println("[red]ERROR:[default] " + err.Error())
 		}
+		exit(status)
 	} else {
-		fmt.Println(`   _____  ____   ____  ______ `)
-		fmt.Println(`  / ____|/ __ \ / __ \|  ____|`)
-		fmt.Println(` | |  __| |  | | |  | | |__   `)
-		fmt.Println(` | | |_ | |  | | |  | |  __|  `)
-		fmt.Println(` | |__| | |__| | |__| | |     `)
-		fmt.Println(`  \_____|\____/ \____/|_|     `)
-		fmt.Println("")
-		fmt.Println("Goof - an optimizing bf VM written in Go")
-		fmt.Println("Version 1.0.2 (REPL mode)")
-		fmt.Println("Collect statistics: ", trackStatistics)
-		fmt.Println("Memory cells available: ", memorySize)
-		colorstring.Println("Type [blue]help[default] to see available commands.")
-		if memorySize <= 64 { // Probably useless but whatever
-			colorstring.Println("[yellow]WARNING:[default] Memory might be too small!")
-		}
-
-		for true {
-			fmt.Print(">>> ")
-			var repl, _ = bufio.NewReader(os.Stdin).ReadString('\n')
-
-			if strings.HasPrefix(repl, "help") {
-				// TODO: Add more commands
-				fmt.Println("List of available commands:")
-				colorstring.Println("[blue]help[default] - print this")
-				colorstring.Println("[blue]clear[default] - clear memory cells")
-				colorstring.Println("[blue]viewmem[default] - displays values of memory cells, cell highlighted in [green]green[default] is the cell currently pointed to")
-			} else if strings.HasPrefix(repl, "clear") {
-				cellptr = 0
-				cells = make([]byte, memorySize)
-			} else if strings.HasPrefix(repl, "viewmem") {
-				dumpMem(&cells, &cellptr)
-			} else {
-				execute(&cells, &cellptr, &repl)
-			}
+		repl()
+		exit(ExitOK)
+	}
+}
+
+// finishOutput writes out everything still held back and closes the -out and
+// -statsfile files
+func finishOutput() error {
+	var err = output.Flush()
+	if outputEncoder != nil {
+		if closeErr := outputEncoder.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for _, file := range []*os.File{outputFile, statsFile} {
+		if file == nil {
+			continue
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return &VMError{ExitIO, err.Error()}
+	}
+	return nil
+}
+
+// exit finishes the output and exits with status, or with ExitIO if a program
+// ran fine but its output couldn't be written
+func exit(status int) {
+	if err := finishOutput(); err != nil {
+		parseMessage("", err.Error(), Error)
+		if status == ExitOK {
+			status = ExitIO
 		}
 	}
+	os.Exit(status)
 }
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// runGoof starts the test binary again to run main with the arguments it
+	// passes in the environment
+	if encoded, ok := os.LookupEnv("GOOF_TEST_ARGS"); ok {
+		var args []string
+		json.Unmarshal([]byte(encoded), &args)
+		os.Args = append([]string{"goof"}, args...)
+		main()
+		os.Exit(ExitOK)
+	}
+	resetFlags()
+	os.Exit(m.Run())
+}
+
+// runGoof runs goof with the given arguments and stdin in a child process,
+// returning what it wrote to stdout and stderr and its exit status
+func runGoof(t *testing.T, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	var encoded, _ = json.Marshal(args)
+	var command = exec.Command(os.Args[0])
+	command.Env = append(os.Environ(), "GOOF_TEST_ARGS="+string(encoded))
+	command.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	command.Stdout, command.Stderr = &stdout, &stderr
+	var err = command.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), command.ProcessState.ExitCode()
+}
+
+// resetFlags puts back the defaults of the flags tests change, as flag
+// defaults only apply once main parses the flags. Diagnostics are discarded
+// unless a test captures them.
+func resetFlags() {
+	memorySize = 30_000
+	optPasses, optLevel, sizeOptimization = 2, 2, false
+	regexOptimizer, useJIT, noOptimizeIO = false, false, false
+	bangInput, semicolonComments, filterMode = false, false, false
+	bankCount, biasTape, tapeData, auxSize = 1, false, nil, 0
+	tapeOutFilename, dumpMemoryFile, emitFormat = "", "", ""
+	trackStatistics, jsonStatistics = false, false
+	wrapPointer, showPointer = false, false
+	breakCell, fillValue = -1, 0
+	decimalOutput, signedCells, utf8Output, outputTable = false, false, false, nil
+	cellSize, cellMask = 8, 0xFF
+	endlessLoopErrors = false
+	diagnostics = io.Discard
+	updateDummyChars()
+}
+
+// testLevel is a way of compiling a program that tests compare against -O0
+type testLevel struct {
+	name  string
+	opts  Options
+	regex bool // Use the regex optimizer
+	jit   bool
+}
+
+var unoptimized = Options{OptPasses: 0, Level: 0}
+
+var testLevels = []testLevel{
+	{name: "O1", opts: Options{OptPasses: 2, Level: 1}},
+	{name: "O2", opts: Options{OptPasses: 2, Level: 2}},
+	{name: "Os", opts: Options{OptPasses: 2, Level: 2, Size: true}},
+	{name: "regexopt", opts: Options{OptPasses: 2, Level: 2}, regex: true},
+	{name: "jit", opts: Options{OptPasses: 2, Level: 2}, jit: true},
+}
+
+// runCode compiles code and runs it on a fresh tape with the given input,
+// returning what it printed and the tape it left behind
+func runCode(t testing.TB, code string, input string, opts Options) (string, []uint32, int, error) {
+	t.Helper()
+	var cells = newTape()
+	var cellptr = tapeOrigin()
+	auxCells = make([]uint32, auxSize)
+	auxCellptr = 0
+	resetBanks()
+	var err error
+	var printed = captureRun(strings.NewReader(input), func() {
+		err = RunOn(cells, &cellptr, code, opts)
+	})
+	return string(printed), cells, cellptr, err
+}
+
+// runLevel is runCode for one of testLevels
+func runLevel(t testing.TB, code string, input string, level testLevel) (string, error) {
+	t.Helper()
+	regexOptimizer, useJIT = level.regex, level.jit
+	defer func() { regexOptimizer, useJIT = false, false }()
+	var printed, _, _, err = runCode(t, code, input, level.opts)
+	return printed, err
+}
+
+// checkLevels runs code at -O0 and at each of testLevels and fails unless they
+// all print output
+func checkLevels(t *testing.T, code string, input string, output string) {
+	t.Helper()
+	var expected, err = runLevel(t, code, input, testLevel{name: "O0", opts: unoptimized})
+	if err != nil || expected != output {
+		t.Fatalf("%s at O0: got %q, %v, want %q", code, expected, err, output)
+	}
+	for _, level := range testLevels {
+		if printed, err := runLevel(t, code, input, level); err != nil || printed != expected {
+			t.Errorf("%s at %s: got %q, %v, want %q", code, level.name, printed, err, expected)
+		}
+	}
+}
+
+func TestCopyLoopInstructions(t *testing.T) {
+	var code = "+++[->+>++>+++<<<]"
+	var tests = []struct {
+		name         string
+		opts         Options
+		instructions []Instruction
+	}{
+		{"checked once", Options{OptPasses: 2, Level: 1}, []Instruction{
+			{ADD_SUB, 3, 0}, {SKP_ZER, 5, 0}, {MUL_CPY, 1, 1}, {MUL_CPY, 2, 2}, {MUL_CPY, 3, 3}, {CLR, 0, 0},
+		}},
+		{"unchecked under -Os", Options{OptPasses: 2, Level: 2, Size: true}, []Instruction{
+			{ADD_SUB, 3, 0}, {MUL_CPY, 1, 1}, {MUL_CPY, 2, 2}, {MUL_CPY, 3, 3}, {CLR, 0, 0},
+		}},
+	}
+	for _, test := range tests {
+		var program, err = Compile(code, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(program.Instructions, test.instructions) {
+			t.Errorf("%s: got %v, want %v", test.name, program.Instructions, test.instructions)
+		}
+	}
+}
+
+func TestCopyLoopOutput(t *testing.T) {
+	checkLevels(t, "+++[->+>++>+++<<<]>.>.>.", "", "\x03\x06\x09")
+	checkLevels(t, "[->+>++>+++<<<]>.>.>.", "", "\x00\x00\x00")
+	checkLevels(t, "++++++[->+>++>+++<<<]>[-<+>>>>+<<<]>>.>.", "", "\x12\x06")
+	checkLevels(t, ">,[-<+++>]<.", "A", "\xc3")
+}
+
+func TestCopyLoopClearsSource(t *testing.T) {
+	defer resetFlags()
+	for _, level := range append([]testLevel{{name: "O0", opts: unoptimized}}, testLevels...) {
+		regexOptimizer, useJIT = level.regex, level.jit
+		var _, cells, cellptr, err = runCode(t, "+++++[->++<]+++[->+<]", "", level.opts)
+		if err != nil || cellptr != 0 || cells[0] != 0 || cells[1] != 13 {
+			t.Errorf("%s: got cells %v with the pointer on %d, %v, want [0 13] on 0", level.name, cells[:2], cellptr, err)
+		}
+	}
+}
+
+func TestCopyLoopOutOfTape(t *testing.T) {
+	defer resetFlags()
+	var tests = []struct {
+		code    string
+		message string
+	}{
+		{">>>>>>>>+[->>>+<<<]", "Copy loop at cell 8 wrote out of the tape to cell 11"},
+		{">+[-<<+>>]", "Copy loop at cell 1 wrote out of the tape to cell -1"},
+	}
+	for _, test := range tests {
+		for _, level := range testLevels {
+			memorySize = 10
+			regexOptimizer, useJIT = level.regex, level.jit
+			var _, _, _, err = runCode(t, test.code, "", level.opts)
+			if err == nil || exitCode(err) != ExitRuntime || !strings.Contains(err.Error(), test.message) {
+				t.Errorf("%s at %s: got %v, want %q", test.code, level.name, err, test.message)
+			}
+		}
+	}
+
+	// With -ptr wrap the copy lands on the other end of the tape
+	memorySize, wrapPointer = 10, true
+	var _, cells, _, err = runCode(t, ">>>>>>>>+[->>>+<<<]", "", testLevels[0].opts)
+	if err != nil || cells[1] != 1 {
+		t.Errorf("-ptr wrap: got cells %v, %v, want cell 1 set to 1", cells, err)
+	}
+}
+
+func TestAdjacentCopyLoops(t *testing.T) {
+	// The second loop finds its source cleared by the first
+	checkLevels(t, "+++[->+<][->>+<<]>>.", "", "\x00")
+	checkLevels(t, "+++[->+<][++++][->>+<<]>>.", "", "\x00")
+	checkLevels(t, "+++[->+<][->+>++<<]>.>.>.", "", "\x03\x00\x00")
+	checkLevels(t, "++>+++<[->+<][->>+<<]>.>.", "", "\x05\x00")
+}
+
+func TestAuxTape(t *testing.T) {
+	auxSize = 2
+	defer resetFlags()
+	// ^ stores the cell in the aux tape and _ loads it back, } and { move the
+	// aux pointer, wrapping around
+	checkLevels(t, "+++^>_.}++^{_.}_.}_.", "", "\x03\x03\x05\x03")
+
+	// Without -aux the characters are comments
+	auxSize = 0
+	checkLevels(t, "+++^>_.", "", "\x00")
+
+	if _, stderr, status := runGoof(t, "", "-aux", "-1", writeProgram(t, "+")); status != 1 || !strings.Contains(stderr, "-aux can't be negative") {
+		t.Errorf("-aux -1 exited with %d and printed %q", status, stderr)
+	}
+}
+
+func TestMoveLeftOfStart(t *testing.T) {
+	defer resetFlags()
+	memorySize = 10
+	// Bounded, the pointer can't leave the tape
+	for _, level := range append([]testLevel{{name: "O0", opts: unoptimized}}, testLevels...) {
+		regexOptimizer, useJIT = level.regex, level.jit
+		var _, _, _, err = runCode(t, "+<+", "", level.opts)
+		if exitCode(err) != ExitRuntime || !strings.Contains(err.Error(), "Pointer moved out of the tape from cell 0 to cell -1") {
+			t.Errorf("bounded at %s: got %v", level.name, err)
+		}
+	}
+	regexOptimizer, useJIT = false, false
+
+	// Wrapping, it goes on from the last cell, and ten moves on a tape of ten
+	// cells come back to the same cell
+	wrapPointer = true
+	checkLevels(t, "+<++.>.<.>>>>>>>>>>.", "", "\x02\x01\x02\x02")
+	var _, cells, cellptr, _ = runCode(t, "<+++", "", unoptimized)
+	if cellptr != 9 || cells[9] != 3 {
+		t.Errorf("wrap: the pointer is on cell %d with cells %v, want cell 9 set to 3", cellptr, cells)
+	}
+	wrapPointer = false
+
+	// On a biased tape there's room to the left
+	biasTape = true
+	checkLevels(t, "+<++.>.<<<+.", "", "\x02\x01\x01")
+}
+
+func TestScanOffTape(t *testing.T) {
+	defer resetFlags()
+	var tests = []struct {
+		code    string
+		message string
+	}{
+		{"[>]", "Right scan ran off the end of the tape at cell 9"},
+		{">>>>>>>>>[<<]", "Left scan ran off the start of the tape at cell 1"},
+	}
+	for _, test := range tests {
+		for _, level := range testLevels {
+			// Every cell is 1, so there's no zero cell to stop on
+			memorySize, fillValue = 10, 1
+			regexOptimizer, useJIT = level.regex, level.jit
+			var _, _, _, err = runCode(t, test.code, "", level.opts)
+			if exitCode(err) != ExitRuntime || !strings.Contains(err.Error(), test.message) {
+				t.Errorf("%s at %s: got %v, want %q", test.code, level.name, err, test.message)
+			}
+		}
+	}
+	regexOptimizer, useJIT = false, false
+
+	// With -ptr wrap scans go on from the other end, and fail once they're
+	// back where they started
+	memorySize, fillValue, wrapPointer = 10, 1, true
+	for _, level := range testLevels {
+		regexOptimizer, useJIT = level.regex, level.jit
+		var _, _, cellptr, err = runCode(t, "[-]>>>>>>>>[>]", "", level.opts)
+		if err != nil || cellptr != 0 {
+			t.Errorf("%s: stopped on cell %d, %v, want cell 0", level.name, cellptr, err)
+		}
+		_, _, _, err = runCode(t, "[<]", "", level.opts)
+		if exitCode(err) != ExitRuntime || !strings.Contains(err.Error(), "Left scan found no zero cell starting from cell 0") {
+			t.Errorf("%s: got %v, want the scan to find no zero cell", level.name, err)
+		}
+	}
+}
+
+// The optimizer never emits a scan that doesn't move, so these programs are
+// put together by hand
+func TestZeroStepScan(t *testing.T) {
+	defer resetFlags()
+	for _, scan := range []byte{SCN_RGT, SCN_LFT} {
+		for _, jit := range []bool{false, true} {
+			useJIT = jit
+			var program = &Program{Instructions: []Instruction{{scan, 0, 0}}}
+			var cells, cellptr = []uint32{0, 1, 0}, 1
+			var err = program.Exec(&cells, &cellptr)
+			if exitCode(err) != ExitRuntime || !strings.Contains(err.Error(), "Scan with a step of 0 would never move") {
+				t.Errorf("%s with jit %v: got %v, want a runtime error", instructionNames[scan], jit, err)
+			}
+		}
+	}
+}
+
+func TestCellSize(t *testing.T) {
+	defer resetFlags()
+	var sizes = []struct {
+		size int
+		mask uint32
+	}{{8, 0xFF}, {16, 0xFFFF}, {32, 0xFFFFFFFF}}
+	var code = "->" + strings.Repeat("+", 256) + ">" + strings.Repeat("+", 65536) + ">-+"
+	for _, size := range sizes {
+		cellSize, cellMask = size.size, size.mask
+		for _, level := range append([]testLevel{{name: "O0", opts: unoptimized}}, testLevels...) {
+			regexOptimizer, useJIT = level.regex, level.jit
+			var _, cells, _, err = runCode(t, code, "", level.opts)
+			// Cells wrap at their own width
+			var expected = []uint32{size.mask, 256 & size.mask, 65536 & size.mask, 0}
+			if err != nil || !reflect.DeepEqual(cells[:4], expected) {
+				t.Errorf("%d bits at %s: got %v, %v, want %v", size.size, level.name, cells[:4], err, expected)
+			}
+		}
+		regexOptimizer, useJIT = false, false
+		// . prints the low byte and , fills it, clearing the rest
+		checkLevels(t, "-.>"+strings.Repeat("+", 321)+".-,.", "A", "\xff\x41A")
+	}
+}
+
+// TestBase64Output sets up the output like main does for -b64out and checks
+// that the last, partial group is only written, padded, by finishOutput
+func TestBase64Output(t *testing.T) {
+	defer resetFlags()
+	var savedOutput = output
+	defer func() { output, outputEncoder = savedOutput, nil }()
+	for _, printed := range []string{"", "A", "AB", "ABC", "ABCD", "\x01\xff\x80\n"} {
+		var code strings.Builder
+		for _, b := range []byte(printed) {
+			code.WriteString("[-]" + strings.Repeat("+", int(b)) + ".")
+		}
+		var encoded bytes.Buffer
+		outputEncoder = base64.NewEncoder(base64.StdEncoding, &encoded)
+		output = bufio.NewWriter(outputEncoder)
+
+		var cells, cellptr = newTape(), 0
+		if err := RunOn(cells, &cellptr, code.String(), Options{OptPasses: 2, Level: 2}); err != nil {
+			t.Fatal(err)
+		}
+		var want = base64.StdEncoding.EncodeToString([]byte(printed))
+		// Only whole groups of three bytes can be encoded before the end
+		var whole = base64.StdEncoding.EncodeToString([]byte(printed[:len(printed)/3*3]))
+		if encoded.String() != whole {
+			t.Errorf("%q: wrote %q before the end, want %q", printed, encoded.String(), whole)
+		}
+		if err := finishOutput(); err != nil || encoded.String() != want {
+			t.Errorf("%q: wrote %q, %v, want %q", printed, encoded.String(), err, want)
+		}
+	}
+}
+
+func TestUTF8Output(t *testing.T) {
+	defer resetFlags()
+	cellSize, cellMask, fillValue = 32, 0xFFFFFFFF, 0x20AC
+	// Each cell is written as the code point it holds
+	utf8Output = true
+	checkLevels(t, ".+.>"+strings.Repeat("-", 0x20AC-'A')+".", "", "€₭A")
+	// Code points above the BMP take four bytes
+	fillValue = 0x1F600
+	checkLevels(t, "..", "", "😀😀")
+
+	// The byte encoding still writes the low byte
+	utf8Output, fillValue = false, 0x20AC
+	checkLevels(t, ".", "", "\xac")
+}
+
+// TestLongPrintRuns prints runs around the size of the chunks writeRepeated
+// writes them in, and one of a million bytes
+func TestLongPrintRuns(t *testing.T) {
+	for _, count := range []int{repeatChunk - 1, repeatChunk, repeatChunk + 1, 3*repeatChunk + 5, 1000000} {
+		// The second run reuses the buffer the first one filled
+		var code = "+++" + strings.Repeat(".", count) + ">++" + strings.Repeat(".", count/2)
+		var want = strings.Repeat("\x03", count) + strings.Repeat("\x02", count/2)
+		for _, level := range append([]testLevel{{name: "O0", opts: unoptimized}}, testLevels...) {
+			// Comparing the output itself would print a megabyte when it fails
+			if printed, err := runLevel(t, code, "", level); err != nil || printed != want {
+				t.Errorf("%d prints at %s: got %d bytes (%d of them 3), %v, want %d", count, level.name, len(printed), strings.Count(printed, "\x03"), err, len(want))
+			}
+		}
+	}
+}
+
+func TestDecimalOutput(t *testing.T) {
+	decimalOutput = true
+	defer resetFlags()
+	// Runs of . print the number as often as a single . would
+	checkLevels(t, "+++.>++++++++++..<+.", "", "3 10 10 4 ")
+	checkLevels(t, "-.", "", "255 ")
+	// Cells known to be zero still print their 0
+	checkLevels(t, "+[-].+.", "", "0 1 ")
+	checkLevels(t, ">+[<].+.", "", "0 1 ")
+	cellSize, cellMask = 16, 0xFFFF
+	defer func() { cellSize, cellMask = 8, 0xFF }()
+	checkLevels(t, "-.", "", "65535 ")
+}
+
+// runFileOutput runs a file like goof does when given it on the command line,
+// with the given input, returning what the program printed
+func runFileOutput(t testing.TB, filename string, input string) (string, error) {
+	t.Helper()
+	var err error
+	var printed = captureRun(strings.NewReader(input), func() {
+		err = runFile(filename)
+	})
+	return string(printed), err
+}
+
+// bundledSkips lists the programs in testprogs that TestBundledPrograms
+// doesn't run, and why
+var bundledSkips = map[string]string{
+	"LostKng.b":    "interactive game",
+	"ant.b":        "runs for minutes without the optimizer",
+	"bad_apple.b":  "runs for minutes without the optimizer",
+	"bench.b":      "benchmark, runs for seconds without the optimizer",
+	"dbfi.b":       "interprets a program read from its input",
+	"e.b":          "prints digits forever",
+	"factor.b":     "runs for minutes without the optimizer",
+	"factorials.b": "prints factorials forever",
+	"gameoflife.b": "interactive",
+	"golden.b":     "prints digits forever",
+	"hanoi.b":      "runs for minutes without the optimizer",
+	"impeccable.b": "runs for minutes without the optimizer",
+	"long.b":       "runs for minutes without the optimizer",
+	"long2.b":      "runs for seconds without the optimizer",
+	"loops.b":      "runs for seconds without the optimizer",
+	"mandelbrot.b": "runs for minutes without the optimizer",
+	"ptmbsg.b":     "prints until it runs off the tape",
+	"random.b":     "prints until it runs off the tape",
+	"rpn.b":        "interactive calculator",
+	"short.b":      "prints forever",
+	"squares2.b":   "runs for minutes without the optimizer",
+	"tests.b":      "collection of snippets that don't compile as one program",
+	"underflow.b":  "meant to be rejected before it runs",
+	"utm.b":        "needs a Turing machine description as input",
+}
+
+// bundledFlags sets the flags that the programs in testprogs ask for in their
+// comments
+var bundledFlags = map[string]func(){
+	"bang.b":      func() { bangInput = true },
+	"banks.b":     func() { bankCount = 2 },
+	"comments.b":  func() { semicolonComments = true },
+	"filter.b":    func() { filterMode = true },
+	"leftward.b":  func() { biasTape = true },
+	"numbers.b":   func() { decimalOutput = true },
+	"printzero.b": func() { noOptimizeIO = true },
+	"signed.b":    func() { decimalOutput, signedCells = true, true },
+	"strict.b":    func() { semicolonComments = true },
+	"tape.b":      func() { tapeData, _ = os.ReadFile("testprogs/tape.txt") },
+	"xlate.b": func() {
+		var table, _ = os.ReadFile("testprogs/rot13.xlate")
+		outputTable = new([256]byte)
+		copy(outputTable[:], table)
+	},
+}
+
+// TestBundledPrograms runs the programs in testprogs with and without the
+// optimizer and compares what they print with the .out file next to them,
+// feeding them the .in file next to them, if there is one
+func TestBundledPrograms(t *testing.T) {
+	var files, err = filepath.Glob("testprogs/*.b")
+	if err != nil || len(files) == 0 {
+		t.Fatal("no bundled programs found", err)
+	}
+	var levels = []struct {
+		name  string
+		level int
+		size  bool
+	}{{"O0", 0, false}, {"O2", 2, false}, {"Os", 2, true}}
+
+	for _, file := range files {
+		var name = filepath.Base(file)
+		var base = strings.TrimSuffix(file, ".b")
+		t.Run(strings.TrimSuffix(name, ".b"), func(t *testing.T) {
+			if reason, ok := bundledSkips[name]; ok {
+				t.Skip(reason)
+			}
+			var expected, err = os.ReadFile(base + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var input, _ = os.ReadFile(base + ".in")
+			for _, level := range levels {
+				resetFlags()
+				optLevel, sizeOptimization = level.level, level.size
+				if optLevel == 0 {
+					optPasses = 0
+				}
+				if setup, ok := bundledFlags[name]; ok {
+					setup()
+				}
+				var printed, err = runFileOutput(t, file, string(input))
+				if err != nil {
+					t.Errorf("%s: %v", level.name, err)
+				} else if printed != string(expected) {
+					t.Errorf("%s: got %q, want %q", level.name, printed, expected)
+				}
+			}
+			resetFlags()
+		})
+	}
+}
+
+// writeProgram writes code to a file in a temporary directory, returning its name
+func writeProgram(t *testing.T, code string) string {
+	t.Helper()
+	var filename = filepath.Join(t.TempDir(), "program.b")
+	if err := os.WriteFile(filename, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestShowPointer(t *testing.T) {
+	defer resetFlags()
+	var tests = []struct {
+		code    string
+		bias    bool
+		pointer string
+	}{
+		{">>>+<", false, "Pointer: 2\n"},
+		{"+[>+>+<<-]>>", false, "Pointer: 2\n"},
+		{"<<+<", true, "Pointer: -3\n"},
+	}
+	for _, test := range tests {
+		var messages bytes.Buffer
+		resetFlags()
+		diagnostics, showPointer, biasTape = &messages, true, test.bias
+		if _, err := runFileOutput(t, writeProgram(t, test.code), ""); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(messages.String(), test.pointer) {
+			t.Errorf("%s: got %q, want it to end with %q", test.code, messages.String(), test.pointer)
+		}
+	}
+}
+
+func TestBreakWhen(t *testing.T) {
+	breakCell, breakValue = 0, 3
+	defer resetFlags()
+	var _, cells, cellptr, err = runCode(t, "+>+<+>+<+>+<+", "", unoptimized)
+	var breakpoint *breakpointError
+	if !errors.As(err, &breakpoint) {
+		t.Fatalf("got %v, want a breakpoint", err)
+	}
+	// The ninth step sets cell 0 to 3, and nothing runs after it
+	if instructionCount != 9 || breakpoint.vm.pc != 9 || cells[0] != 3 || cells[1] != 2 || cellptr != 0 {
+		t.Errorf("stopped after %d steps before instruction %d with cells %v, want 9 steps, instruction 9 and [3 2]", instructionCount, breakpoint.vm.pc, cells[:2])
+	}
+	if exitCode(err) != ExitRuntime || !strings.Contains(err.Error(), "Cell 0 reached 3 (instruction 8)") {
+		t.Errorf("got %q with status %d", err, exitCode(err))
+	}
+
+	// Copies count as writes to their target
+	breakCell, breakValue = 1, 6
+	_, cells, _, err = runCode(t, "++[->+++<]", "", Options{OptPasses: 2, Level: 2})
+	if !errors.As(err, &breakpoint) || cells[1] != 6 {
+		t.Errorf("got %v with cells %v, want a breakpoint with cell 1 at 6", err, cells[:2])
+	}
+}
+
+func TestFilter(t *testing.T) {
+	defer resetFlags()
+	var tests = []struct {
+		name   string
+		code   string
+		filter bool
+		input  string
+		output string
+	}{
+		{"every line", "+[>,.----------]", true, "one\ntwo\nthree\n", "one\ntwo\nthree\n"},
+		{"one line without -filter", "+[>,.----------]", false, "one\ntwo\nthree\n", "one\n"},
+		// The counter in cell 0 carries over from one run to the next
+		{"tape kept between runs", "+.>,<", true, "abc", "\x01\x02\x03"},
+		{"no input", "+.>,<", true, "", "\x01"},
+	}
+	var filename = writeProgram(t, "")
+	for _, test := range tests {
+		if err := os.WriteFile(filename, []byte(test.code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, level := range []int{0, 2} {
+			resetFlags()
+			filterMode, optLevel = test.filter, level
+			var printed, err = runFileOutput(t, filename, test.input)
+			if err != nil {
+				t.Errorf("%s at O%d: %v", test.name, level, err)
+			} else if printed != test.output {
+				t.Errorf("%s at O%d: got %q, want %q", test.name, level, printed, test.output)
+			}
+		}
+	}
+}
+
+func TestBiasedTapeFiles(t *testing.T) {
+	defer resetFlags()
+	var tests = []struct {
+		name string
+		code string
+		tape string
+		dump string
+	}{
+		{"round trip", "+", "BBC", `{"pointer":0,"cells":[66,66,67]}`},
+		{"pointer moved right", ">>>>", "ABC\x00\x00", `{"pointer":4,"cells":[65,66,67,0,0]}`},
+		// Cells left of the origin can't be loaded back, so they aren't saved
+		{"pointer moved left", "<+", "ABC", `{"pointer":-1,"cells":[65,66,67]}`},
+	}
+	var directory = t.TempDir()
+	var tapeFile, dumpFile = filepath.Join(directory, "out.tape"), filepath.Join(directory, "dump.json")
+	for _, test := range tests {
+		resetFlags()
+		memorySize, biasTape, tapeData = 20, true, []byte("ABC")
+		tapeOutFilename, dumpMemoryFile = tapeFile, dumpFile
+		if _, err := runFileOutput(t, writeProgram(t, test.code), ""); err != nil {
+			t.Fatal(err)
+		}
+		if tape, _ := os.ReadFile(tapeFile); string(tape) != test.tape {
+			t.Errorf("%s: -tapeout wrote %q, want %q", test.name, tape, test.tape)
+		}
+		if dump, _ := os.ReadFile(dumpFile); string(dump) != test.dump+"\n" {
+			t.Errorf("%s: -dmfile wrote %q, want %q", test.name, dump, test.dump)
+		}
+	}
+}
+
+func TestJSONStatistics(t *testing.T) {
+	var report bytes.Buffer
+	var savedStatsOutput = statsOutput
+	trackStatistics, jsonStatistics, statsOutput = true, true, &report
+	defer func() {
+		statsOutput = savedStatsOutput
+		resetFlags()
+	}()
+	if _, _, _, err := runCode(t, "+++[->++<]>.", "", unoptimized); err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(report.Bytes(), &fields); err != nil {
+		t.Fatalf("%q isn't a JSON object: %v", report.String(), err)
+	}
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var expected = []string{"code_length", "compiled_instructions", "compiler_ns", "io_wait_ns", "optimized_steps", "optimizer_ns", "steps", "total_ns", "vm_ns"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got fields %v, want %v", names, expected)
+	}
+
+	var parsed statisticsReport
+	json.Unmarshal(report.Bytes(), &parsed)
+	var compiled = 0
+	for _, count := range parsed.CompiledInstructions {
+		compiled += count
+	}
+	// The loop body runs three times, so more instructions run than there are
+	if compiled == 0 || parsed.Steps <= compiled {
+		t.Errorf("got %d steps and %v compiled instructions, want more steps than instructions", parsed.Steps, parsed.CompiledInstructions)
+	}
+}
+
+func TestOutputFiles(t *testing.T) {
+	var directory = t.TempDir()
+	var outFile, statsFile = filepath.Join(directory, "out"), filepath.Join(directory, "stats.json")
+	var stdout, stderr, status = runGoof(t, "", "-out", outFile, "-statsfile", statsFile, "-json", "-flush", "none", writeProgram(t, "++++++++[>++++++++<-]>+.+."))
+	if status != ExitOK || stdout != "" {
+		t.Fatalf("exited with %d, printed %q and %q", status, stdout, stderr)
+	}
+	if printed, _ := os.ReadFile(outFile); string(printed) != "AB" {
+		t.Errorf("-out wrote %q, want \"AB\"", printed)
+	}
+	var report statisticsReport
+	if data, _ := os.ReadFile(statsFile); json.Unmarshal(data, &report) != nil || report.Steps == 0 {
+		t.Errorf("-statsfile wrote %q, want a JSON report", data)
+	}
+
+	// Neither file is created when a flag is wrong
+	os.Remove(outFile)
+	os.Remove(statsFile)
+	if _, _, status = runGoof(t, "", "-out", outFile, "-statsfile", statsFile, "-ptr", "nowhere", writeProgram(t, "+")); status != 1 {
+		t.Errorf("exited with %d, want 1", status)
+	}
+	for _, file := range []string{outFile, statsFile} {
+		if _, err := os.Stat(file); err == nil {
+			t.Errorf("%s was created for a bad flag", filepath.Base(file))
+		}
+	}
+	if _, _, status = runGoof(t, "", "-out", filepath.Join(directory, "missing", "out"), writeProgram(t, "+")); status != ExitIO {
+		t.Errorf("exited with %d for an -out file that can't be created, want %d", status, ExitIO)
+	}
+}
+
+func TestProgramInput(t *testing.T) {
+	var inputFile = filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(inputFile, []byte("from a file\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Stdin is ignored when either flag gives the input
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"testprogs/cat.b"}, "from stdin"},
+		{[]string{"-input", "from a flag", "testprogs/cat.b"}, "from a flag"},
+		{[]string{"-inputfile", inputFile, "testprogs/cat.b"}, "from a file\n"},
+	} {
+		if stdout, stderr, status := runGoof(t, "from stdin", test.args...); status != ExitOK || stdout != test.want {
+			t.Errorf("%v: exited with %d, printed %q and %q, want %q", test.args, status, stdout, stderr, test.want)
+		}
+	}
+
+	if _, stderr, status := runGoof(t, "", "-inputfile", filepath.Join(t.TempDir(), "missing"), "testprogs/cat.b"); status != ExitIO || !strings.Contains(stderr, "ERROR") {
+		t.Errorf("exited with %d and printed %q for a missing -inputfile, want %d", status, stderr, ExitIO)
+	}
+	if _, _, status := runGoof(t, "", "-input", "x", "-inputfile", inputFile, "testprogs/cat.b"); status != 1 {
+		t.Errorf("exited with %d for both -input and -inputfile, want 1", status)
+	}
+}
+
+func TestStepCount(t *testing.T) {
+	var program = writeProgram(t, "++[-]")
+	var tests = []struct {
+		args []string
+		want string
+	}{
+		// The optimizer turns the loop into a clear, dropping the additions
+		// before it
+		{nil, "Steps: 1\n"},
+		// One step for the additions and the [, then the - and the ] twice
+		{[]string{"-O0", "-o", "0"}, "Steps: 6\n"},
+	}
+	for _, test := range tests {
+		var _, stderr, status = runGoof(t, "", append(append([]string{"-stepcount"}, test.args...), program)...)
+		if status != ExitOK || !strings.Contains(stderr, "\n"+test.want) {
+			t.Errorf("%v: exited with %d and printed %q, want %q", test.args, status, stderr, test.want)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	var tests = []struct {
+		depth  string
+		status int
+		stderr string
+	}{
+		{"3", ExitSyntax, "Loops nested more than 3 deep at line 8, column 4"},
+		{"7", ExitSyntax, "Loops nested more than 7 deep"},
+		{"8", ExitOK, ""},
+	}
+	for _, test := range tests {
+		var stdout, stderr, status = runGoof(t, "", "-maxdepth", test.depth, "testprogs/deep.b")
+		if status != test.status || !strings.Contains(stderr, test.stderr) {
+			t.Errorf("-maxdepth %s: exited with %d and printed %q, want %d and %q", test.depth, status, stderr, test.status, test.stderr)
+		}
+		if status == ExitOK && stdout != "!" {
+			t.Errorf("-maxdepth %s: printed %q, want \"!\"", test.depth, stdout)
+		}
+	}
+}
+
+func TestTapeSizeFlag(t *testing.T) {
+	var program = writeProgram(t, "+.")
+	for _, size := range []string{"0", "-5"} {
+		if _, stderr, status := runGoof(t, "", "-m", size, program); status != 1 || !strings.Contains(stderr, "-m must be at least 1") {
+			t.Errorf("-m %s: exited with %d and printed %q, want 1", size, status, stderr)
+		}
+	}
+	if stdout, stderr, status := runGoof(t, "", "-m", "1", program); status != ExitOK || stdout != "\x01" {
+		t.Errorf("-m 1: exited with %d and printed %q and %q", status, stdout, stderr)
+	}
+}
+
+// TestSelfTestFlags runs -selftest with flags that change what programs
+// print, which the self-tests must ignore
+func TestSelfTestFlags(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"-numout"},
+		{"-numout", "-signed", "-cellsize", "16"},
+		{"-encoding", "utf8", "-ascii-only", "error"},
+		{"-xlate", "testprogs/rot13.xlate", "-echo"},
+		{"-b64out", "-maxcell", "3"},
+	} {
+		var _, stderr, status = runGoof(t, "", append([]string{"-selftest"}, args...)...)
+		if status != ExitOK || !strings.Contains(stderr, "12 of 12 self-tests passed") {
+			t.Errorf("%v: exited with %d and printed %q", args, status, stderr)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// TapeMemory gives tools a byte view of a tape through io.ReaderAt and
+// io.WriterAt. Each cell takes -cellsize/8 bytes, little-endian, so byte
+// offset off is in cell off/(cellsize/8).
+//
+// It reads and writes the tape in place without any locking. Only use it
+// while nothing runs on the tape: before or after Exec, or while the
+// debugger is waiting for a command. Writes are masked to the cell size.
+type TapeMemory struct {
+	cells *[]uint32
+}
+
+// NewTapeMemory returns a byte view of the given tape
+func NewTapeMemory(cells *[]uint32) *TapeMemory {
+	return &TapeMemory{cells}
+}
+
+// Memory returns a byte view of the tape the machine runs on
+func (m *machine) Memory() *TapeMemory {
+	return NewTapeMemory(m.cells)
+}
+
+// cellBytes is how many bytes a cell takes in the byte view
+func cellBytes() int64 {
+	return int64(cellSize / 8)
+}
+
+// Size returns the length of the tape in bytes, which is -m cells of
+// -cellsize/8 bytes for the tapes goof makes
+func (t *TapeMemory) Size() int64 {
+	return int64(len(*t.cells)) * cellBytes()
+}
+
+// ReadAt reads the bytes of the cells from byte offset off, stopping with
+// io.EOF at the end of the tape
+func (t *TapeMemory) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, newError(ExitRuntime, "Negative offset %d", off)
+	}
+	var width = cellBytes()
+	var cell [4]byte
+	var n = 0
+	for ; n < len(p) && off < t.Size(); n, off = n+1, off+1 {
+		binary.LittleEndian.PutUint32(cell[:], (*t.cells)[off/width])
+		p[n] = cell[off%width]
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes bytes of the cells from byte offset off, stopping with
+// io.EOF at the end of the tape
+func (t *TapeMemory) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, newError(ExitRuntime, "Negative offset %d", off)
+	}
+	var width = cellBytes()
+	var cell [4]byte
+	var n = 0
+	for ; n < len(p) && off < t.Size(); n, off = n+1, off+1 {
+		var value = &(*t.cells)[off/width]
+		binary.LittleEndian.PutUint32(cell[:], *value)
+		cell[off%width] = p[n]
+		*value = binary.LittleEndian.Uint32(cell[:]) & cellMask
+	}
+	if n > 0 {
+		// Any cell may now be non-zero
+		setExtent(*t.cells, len(*t.cells)-1)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestTapeMemory(t *testing.T) {
+	defer resetFlags()
+	for _, size := range []struct {
+		bits int
+		mask uint32
+	}{{8, 0xFF}, {16, 0xFFFF}, {32, 0xFFFFFFFF}} {
+		cellSize, cellMask = size.bits, size.mask
+		memorySize = 4
+		var width = size.bits / 8
+		var cells = newTape()
+		var cellptr = 0
+		var memory = NewTapeMemory(&cells)
+		if memory.Size() != int64(4*width) {
+			t.Fatalf("%d-bit cells: size %d, want %d", size.bits, memory.Size(), 4*width)
+		}
+
+		// Cell 0 is 2 and cell 1 is 3, then the program moves cell 0 into
+		// cell 1 and adds one to it
+		var patch = make([]byte, 2*width)
+		patch[0], patch[width] = 2, 3
+		if n, err := memory.WriteAt(patch, 0); n != len(patch) || err != nil {
+			t.Fatalf("%d-bit cells: wrote %d bytes, %v", size.bits, n, err)
+		}
+		if err := RunOn(cells, &cellptr, "[->+<]>+", Options{OptPasses: 2, Level: 2}); err != nil {
+			t.Fatal(err)
+		}
+		var read = make([]byte, 2*width)
+		var want = make([]byte, 2*width)
+		want[width] = 6
+		if n, err := memory.ReadAt(read, 0); n != len(read) || err != nil || !bytes.Equal(read, want) {
+			t.Errorf("%d-bit cells: read %v, %d bytes, %v, want %v", size.bits, read, n, err, want)
+		}
+
+		// Both stop at the end of the tape
+		var end = memory.Size() - 1
+		if n, err := memory.WriteAt([]byte{7, 7}, end); n != 1 || err != io.EOF {
+			t.Errorf("%d-bit cells: wrote %d bytes at the end, %v, want 1 and EOF", size.bits, n, err)
+		}
+		if n, err := memory.ReadAt(read[:2], end); n != 1 || err != io.EOF || read[0] != 7 {
+			t.Errorf("%d-bit cells: read %v, %d bytes at the end, %v, want 7, 1 and EOF", size.bits, read[:1], n, err)
+		}
+		if n, err := memory.ReadAt(read, memory.Size()+10); n != 0 || err != io.EOF {
+			t.Errorf("%d-bit cells: read %d bytes past the end, %v, want EOF", size.bits, n, err)
+		}
+		if _, err := memory.ReadAt(read, -1); err == nil || !strings.Contains(err.Error(), "Negative offset") {
+			t.Errorf("%d-bit cells: got %v for a negative offset", size.bits, err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import "strings"
+
+// optimizeTokens performs the same rewrites as the regex optimizer in a single
+// scan over the source. Commands are appended to the output one at a time,
+// folding with what's already there, and each loop is rewritten when its
+// closing bracket is reached, at which point its body is fully optimized.
+// Operands are only ever appended, since P, R and L tokens are never removed
+// once emitted. It also returns the offset in code of the command each output
+// token came from, with tokens that replace a loop pointing at its [.
+func optimizeTokens(code string, passes int) (string, LoopData, []int) {
+	return optimizeTokenStages(code, passes, nil)
+}
+
+// optimizeTokenStages is optimizeTokens, calling stage, if it isn't nil, with
+// the code as it stands after each loop is rewritten, for the explain command.
+// The code passed is what has been optimized so far followed by the commands
+// still to come.
+func optimizeTokenStages(code string, passes int, stage func(label string, code string)) (string, LoopData, []int) {
+	var loops = LoopData{make([]int, 0), make([]int, 0), make([]int, 0), make([]int, 0)}
+	var commands = commandChars()
+
+	var out = make([]byte, 0, len(code))
+	var origins = make([]int, 0, len(code))
+	var loopStarts = make([]int, 0)
+	var last = func() byte {
+		if len(out) == 0 {
+			return 0
+		}
+		return out[len(out)-1]
+	}
+	var push = func(char byte, at int) {
+		out = append(out, char)
+		origins = append(origins, at)
+	}
+	var truncate = func(length int) {
+		out = out[:length]
+		origins = origins[:length]
+	}
+	// Scans and copy loops leave the pointer on a zero cell
+	var knownZero = func() bool {
+		return last() == 'C' || last() == 'R' || last() == 'L' || last() == 'P'
+	}
+	// clear emits C, dropping changes to the cell right before it and the C
+	// itself when the cell is already known to be zero
+	var clear = func(at int) {
+		for len(out) > 0 && strings.IndexByte("+-C", last()) != -1 {
+			truncate(len(out) - 1)
+		}
+		if !knownZero() {
+			push('C', at)
+		}
+	}
+
+	var commandsOnly = func(code string) string {
+		return strings.Map(func(r rune) rune {
+			if r < 0x80 && strings.IndexByte(commands, byte(r)) != -1 {
+				return r
+			}
+			return -1
+		}, code)
+	}
+	var snapshot = func(label string, i int) {
+		if stage != nil {
+			stage(label, string(out)+commandsOnly(code[i+1:]))
+		}
+	}
+	if stage != nil {
+		stage("Strip comments", commandsOnly(code))
+	}
+
+	for i := 0; i < len(code); i++ {
+		var char = code[i]
+		if strings.IndexByte(commands, char) == -1 {
+			continue
+		}
+
+		switch {
+		case char == '+' && last() == '-', char == '-' && last() == '+',
+			char == '>' && last() == '<', char == '<' && last() == '>':
+			truncate(len(out) - 1)
+		case passes == 0:
+			push(char, i)
+		case char == '.' && knownZero() && !keepPrints():
+			// Printing a cell that is known to be zero is dropped
+		case char == ',' && !noOptimizeIO:
+			for len(out) > 0 && strings.IndexByte("+-C", last()) != -1 {
+				truncate(len(out) - 1)
+			}
+			push(',', i)
+		case char == '[':
+			loopStarts = append(loopStarts, len(out))
+			push('[', i)
+		case char == ']' && len(loopStarts) > 0:
+			var start = loopStarts[len(loopStarts)-1]
+			loopStarts = loopStarts[:len(loopStarts)-1]
+			var at = origins[start]
+			var body = string(out[start+1:])
+			switch {
+			case body == "":
+				// An empty loop is dropped
+				truncate(start)
+				snapshot("Empty loop", i)
+			case strings.Trim(body, "+-") == "", body == "C":
+				// A loop around a clear also only clears, it runs once
+				truncate(start)
+				clear(at)
+				snapshot("Clear loop", i)
+			case strings.Trim(body, ">") == "" || strings.Trim(body, "<") == "":
+				truncate(start)
+				loops.ScanSteps = append(loops.ScanSteps, len(body))
+				if body[0] == '>' {
+					push('R', at)
+				} else {
+					push('L', at)
+				}
+				snapshot("Scan loop", i)
+			default:
+				if offsets, multipliers, ok := parseCopyloop(body); ok {
+					truncate(start)
+					loops.CopyOffsets = append(loops.CopyOffsets, offsets...)
+					loops.CopyMultipliers = append(loops.CopyMultipliers, multipliers...)
+					loops.CopyCounts = append(loops.CopyCounts, len(offsets))
+					for range offsets {
+						push('P', at)
+					}
+					snapshot("Copy loop", i)
+				} else {
+					push(']', i)
+				}
+			}
+		default:
+			push(char, i)
+		}
+	}
+
+	return string(out), loops, origins
+}
+
+// parseCopyloop recognizes the body of a loop that decrements its cell once
+// per iteration and adds it to other cells, like ->+>++<< or >+<-, returning
+// the offset and multiplier of each target
+func parseCopyloop(body string) (offsets []int, multipliers []int, ok bool) {
+	if strings.HasPrefix(body, "-") {
+		body = body[1:]
+	} else if strings.HasSuffix(body, "-") {
+		body = body[:len(body)-1]
+	} else {
+		return nil, nil, false
+	}
+
+	var offset = 0
+	var i = 0
+	for i < len(body) {
+		var moves = i
+		for i < len(body) && (body[i] == '>' || body[i] == '<') {
+			if body[i] == '>' {
+				offset++
+			} else {
+				offset--
+			}
+			i++
+		}
+		var pluses = i
+		for i < len(body) && body[i] == '+' {
+			i++
+		}
+		if pluses == moves || i < len(body) && i == pluses {
+			return nil, nil, false
+		}
+		if i > pluses {
+			offsets = append(offsets, offset)
+			multipliers = append(multipliers, i-pluses)
+		} else if offset != 0 || len(offsets) == 0 {
+			return nil, nil, false
+		}
+	}
+	if i == 0 || body[len(body)-1] == '+' {
+		return nil, nil, false
+	}
+	return offsets, multipliers, true
+}
+
+// peephole merges neighbouring instructions that compilation can leave behind:
+// ADD_SUBs and PTR_MOVs add up, also when only AUX_MOVs separate two
+// PTR_MOVs, a CLR right after another is dropped and so are ADD_SUBs and
+// PTR_MOVs that end up doing nothing. A CLR followed by ADD_SUBs becomes a
+// SET_VAL of their sum. An instruction that a
+// jump lands on is never merged into the one before it. Jumps are relinked
+// to the new indices. positions holds the source offset of each instruction
+// and is updated to match, merged instructions keep the offset of the first.
+func peephole(instructions []Instruction, positions []int) ([]Instruction, []int) {
+	// Every jump continues at the instruction after its Data
+	var landing = make([]bool, len(instructions)+1)
+	for _, instruction := range instructions {
+		switch instruction.Type {
+		case JMP_ZER, JMP_NOT_ZER, SKP_ZER:
+			landing[instruction.Data+1] = true
+		}
+	}
+
+	var optimized = make([]Instruction, 0, len(instructions))
+	var kept = make([]int, 0, len(positions))
+	var newIndex = make([]int, len(instructions)+1)
+	// Instructions before fixed can't absorb anything, as a jump lands
+	// between them and the instructions still to come
+	var fixed = 0
+	for i, instruction := range instructions {
+		newIndex[i] = len(optimized)
+		if landing[i] {
+			fixed = len(optimized)
+		}
+		if len(optimized) <= fixed {
+			optimized = append(optimized, instruction)
+			kept = append(kept, positions[i])
+			continue
+		}
+
+		// A move can also join one before aux moves, which don't use the pointer,
+		// so moves there and back around them cancel out
+		var j = len(optimized) - 1
+		if instruction.Type == PTR_MOV {
+			for j > fixed && optimized[j].Type == AUX_MOV {
+				j--
+			}
+		}
+		var last = &optimized[j]
+		switch {
+		case instruction.Type == CLR && (last.Type == CLR || last.Type == SET_VAL):
+			last.Type, last.Data = CLR, 0
+		case instruction.Type == ADD_SUB && (last.Type == CLR || last.Type == SET_VAL):
+			last.Type, last.Data = SET_VAL, int(uint32(last.Data+instruction.Data)&cellMask)
+			if last.Data == 0 {
+				last.Type = CLR
+			}
+		case instruction.Type == last.Type && (instruction.Type == ADD_SUB || instruction.Type == PTR_MOV):
+			last.Data += instruction.Data
+			if last.Type == ADD_SUB && uint32(last.Data)&cellMask == 0 || last.Type == PTR_MOV && last.Data == 0 {
+				optimized = append(optimized[:j], optimized[j+1:]...)
+				kept = append(kept[:j], kept[j+1:]...)
+			}
+		default:
+			optimized = append(optimized, instruction)
+			kept = append(kept, positions[i])
+		}
+	}
+	newIndex[len(instructions)] = len(optimized)
+
+	for i, instruction := range optimized {
+		switch instruction.Type {
+		case JMP_ZER, JMP_NOT_ZER, SKP_ZER:
+			optimized[i].Data = newIndex[instruction.Data+1] - 1
+		}
+	}
+	return optimized, kept
+}
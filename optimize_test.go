@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ints returns its arguments as a slice that is never nil, like the ones
+// Optimize builds
+func ints(values ...int) []int {
+	return append([]int{}, values...)
+}
+
+var optimizeTests = []struct {
+	name   string
+	code   string
+	tokens string
+	loops  LoopData
+}{
+	{"comments", "a+b c", "+", LoopData{}},
+	{"cancelling commands", "+-><", "", LoopData{}},
+	{"clear", "[-]", "C", LoopData{}},
+	{"clear by adding", "[+]", "C", LoopData{}},
+	{"changes before a clear", "+++[-]", "C", LoopData{}},
+	{"changes after a clear", "+[-]-", "C-", LoopData{}},
+	{"repeated clears", "[-][-]", "C", LoopData{}},
+	{"nested clear", "[[-]]", "C", LoopData{}},
+	{"nested clear with a body", "[[-]>+<]", "[C>+<]", LoopData{}},
+	{"print after a clear", "[-].", "C", LoopData{}},
+	{"clear after a move", ">[-]", ">C", LoopData{}},
+	{"scan right", "[>]", "R", LoopData{ScanSteps: ints(1)}},
+	{"scan left", "[<<]", "L", LoopData{ScanSteps: ints(2)}},
+	{"scans in order", "[>][<<]", "RL", LoopData{ScanSteps: ints(1, 2)}},
+	{"print after a scan", "[>].", "R", LoopData{ScanSteps: ints(1)}},
+	{"nested scan", "[[>]]", "[R]", LoopData{ScanSteps: ints(1)}},
+	{"empty loop", "[]", "", LoopData{}},
+	{"changes before input", "++,", ",", LoopData{}},
+	{"clear before input", ",[-]+,", ",,", LoopData{}},
+	{"copy", "[->+<]", "P", LoopData{CopyOffsets: ints(1), CopyMultipliers: ints(1), CopyCounts: ints(1)}},
+	{"copy decrementing last", "[>+<-]", "P", LoopData{CopyOffsets: ints(1), CopyMultipliers: ints(1), CopyCounts: ints(1)}},
+	{"copy to several cells", "[->+>++<<]", "PP", LoopData{CopyOffsets: ints(1, 2), CopyMultipliers: ints(1, 2), CopyCounts: ints(2)}},
+	{"copy left", "[-<<+++>>]", "P", LoopData{CopyOffsets: ints(-2), CopyMultipliers: ints(3), CopyCounts: ints(1)}},
+	{"subtracting loop", "[->-<]", "[->-<]", LoopData{}},
+	{"unbalanced copy", "[->+<<]", "[->+<<]", LoopData{}},
+	{"loop without a decrement", "[>+<]", "[>+<]", LoopData{}},
+	{"adjacent copies", "[->+<][->>+<<]", "PP", LoopData{CopyOffsets: ints(1, 2), CopyMultipliers: ints(1, 1), CopyCounts: ints(1, 1)}},
+	{"adjacent copies around a clear", "+++[->+<][++++][->>+<<]", "+++PP", LoopData{CopyOffsets: ints(1, 2), CopyMultipliers: ints(1, 1), CopyCounts: ints(1, 1)}},
+	{"adjacent copies of several cells", "[->+>+<<][->>>+++<<<]", "PPP", LoopData{CopyOffsets: ints(1, 2, 3), CopyMultipliers: ints(1, 1, 3), CopyCounts: ints(2, 1)}},
+	{"combined", "[-]>[>>]<<[->+<]", "C>R<<P", LoopData{CopyOffsets: ints(1), CopyMultipliers: ints(1), ScanSteps: ints(2), CopyCounts: ints(1)}},
+}
+
+// normalized returns loops with nil for every empty slice, so expected values
+// can leave them out
+func normalized(loops LoopData) LoopData {
+	for _, field := range []*[]int{&loops.CopyOffsets, &loops.CopyMultipliers, &loops.ScanSteps, &loops.CopyCounts} {
+		if len(*field) == 0 {
+			*field = nil
+		}
+	}
+	return loops
+}
+
+func TestOptimize(t *testing.T) {
+	for _, regex := range []bool{false, true} {
+		regexOptimizer = regex
+		for _, test := range optimizeTests {
+			var tokens, loops, _ = Optimize(test.code, 2)
+			if tokens != test.tokens {
+				t.Errorf("%s (regexopt %t): %q gave %q, want %q", test.name, regex, test.code, tokens, test.tokens)
+			}
+			if !reflect.DeepEqual(normalized(loops), test.loops) {
+				t.Errorf("%s (regexopt %t): %q gave %+v, want %+v", test.name, regex, test.code, loops, test.loops)
+			}
+		}
+	}
+	regexOptimizer = false
+}
+
+func TestOptimizeOrigins(t *testing.T) {
+	var tokens, _, origins = optimizeTokens("+ [->+<] > .", 2)
+	if tokens != "+P>." || !reflect.DeepEqual(origins, []int{0, 2, 9, 11}) {
+		t.Errorf("got %q from %v, want \"+P>.\" from [0 2 9 11]", tokens, origins)
+	}
+}
+
+func TestNestedClearLoops(t *testing.T) {
+	// A loop wrapping only a clear runs once, so it's a clear too
+	checkLevels(t, "+++++[[-]]>+<.>.", "", "\x00\x01")
+	// One that does more isn't, but its inner clear still is
+	checkLevels(t, "+++[[-]>+<]>.", "", "\x01")
+	checkLevels(t, "++++[-[-]]>[[-]>++<]>.", "", "\x00")
+	checkLevels(t, "++[>+++[[-]>+<]<-]>>.", "", "\x02")
+}
+
+// fuzzSteps bounds how many instructions FuzzOptimize runs a program for, so
+// programs that never end don't hang the fuzzer
+const fuzzSteps = 100_000
+
+// balancedProgram keeps only the commands of code, dropping brackets that
+// close nothing and closing the loops left open at the end
+func balancedProgram(code string) string {
+	var program strings.Builder
+	var open = 0
+	for i := 0; i < len(code); i++ {
+		switch code[i] {
+		case '+', '-', '<', '>', '.', ',':
+			program.WriteByte(code[i])
+		case '[':
+			open++
+			program.WriteByte('[')
+		case ']':
+			if open > 0 {
+				open--
+				program.WriteByte(']')
+			}
+		}
+	}
+	program.WriteString(strings.Repeat("]", open))
+	return program.String()
+}
+
+// boundedRun is the outcome of running a program for at most fuzzSteps steps
+type boundedRun struct {
+	output   string
+	cells    []uint32
+	cellptr  int
+	finished bool
+	err      error
+}
+
+// runBounded runs code on a fresh tape with the given input for at most steps
+// instructions
+func runBounded(t *testing.T, code string, input string, opts Options, steps int) boundedRun {
+	t.Helper()
+	var program, err = Compile(code, opts)
+	if err != nil {
+		return boundedRun{err: err}
+	}
+	var buffer bytes.Buffer
+	var savedOutput, savedInput = output, programInput
+	output = bufio.NewWriter(&buffer)
+	programInput = bufio.NewReader(strings.NewReader(input))
+	defer func() { output, programInput = savedOutput, savedInput }()
+
+	var run = boundedRun{cells: make([]uint32, memorySize)}
+	var vm = machine{program: program, instructions: program.Instructions, cells: &run.cells, cellptr: &run.cellptr}
+	run.err = vm.run(steps)
+	run.finished = vm.finished()
+	output.Flush()
+	run.output = buffer.String()
+	return run
+}
+
+// FuzzOptimize checks that optimized programs leave the same tape and print
+// the same as unoptimized ones. The optimizer drops prints of cells it knows
+// are zero, so zero bytes are left out of the comparison. Programs that fail
+// or don't end within fuzzSteps unoptimized are skipped.
+func FuzzOptimize(f *testing.F) {
+	for _, seed := range []string{
+		"+++[->+<][->>+<<]>>.",
+		"+++[->+<][++++][->>+<<]>>.",
+		"++>+++<[->+<][->>+<<]>.>.",
+		"+++[[-]>+<]>.",
+		"+++++[[-]]>+<.>.",
+		"+>+>+<<[>]<[<]>.",
+		"++[>+++[[-]>+<]<-]>>.",
+		"+[-].+,.[-],.",
+		",[->++>+++<<]>.>.",
+		"++++[->+>++>+++<<<]>[-<+>>>>+<<<]>>.>.",
+		"+>>+<<[->[-]<]>>.",
+	} {
+		f.Add(seed, "ab")
+	}
+	var levels = []struct {
+		name  string
+		opts  Options
+		regex bool
+	}{
+		{"O2", Options{OptPasses: 2, Level: 2}, false},
+		{"Os", Options{OptPasses: 2, Level: 2, Size: true}, false},
+		{"regexopt", Options{OptPasses: 2, Level: 2}, true},
+	}
+	f.Fuzz(func(t *testing.T, code string, input string) {
+		resetFlags()
+		memorySize = 64
+		defer resetFlags()
+		code = balancedProgram(code)
+
+		var expected = runBounded(t, code, input, unoptimized, fuzzSteps)
+		if expected.err != nil || !expected.finished {
+			return
+		}
+		for _, level := range levels {
+			regexOptimizer = level.regex
+			var actual = runBounded(t, code, input, level.opts, fuzzSteps)
+			switch {
+			case actual.err != nil:
+				t.Errorf("%s at %s failed: %v", code, level.name, actual.err)
+			case !actual.finished:
+				t.Errorf("%s at %s didn't end", code, level.name)
+			case strings.ReplaceAll(actual.output, "\x00", "") != strings.ReplaceAll(expected.output, "\x00", ""):
+				t.Errorf("%s at %s printed %q, want %q", code, level.name, actual.output, expected.output)
+			case actual.cellptr != expected.cellptr || !reflect.DeepEqual(actual.cells, expected.cells):
+				t.Errorf("%s at %s left the pointer on %d and cells %v, want %d and %v", code, level.name, actual.cellptr, actual.cells, expected.cellptr, expected.cells)
+			}
+		}
+	})
+}
+
+func TestNoOptimizeIO(t *testing.T) {
+	noOptimizeIO = true
+	defer resetFlags()
+	var tests = []struct {
+		code   string
+		tokens string
+	}{
+		{"[-].", "C."},
+		{"[>].", "R."},
+		{"++,", "++,"},
+		{",[-]+,", ",C+,"},
+		// The other optimizations still apply
+		{"+-[-]>+<[->+<]", "C>+<P"},
+	}
+	for _, regex := range []bool{false, true} {
+		regexOptimizer = regex
+		for _, test := range tests {
+			if tokens, _, _ := Optimize(test.code, 2); tokens != test.tokens {
+				t.Errorf("regexopt %t: %q gave %q, want %q", regex, test.code, tokens, test.tokens)
+			}
+		}
+	}
+	regexOptimizer = false
+
+	// Prints of a cell cleared just before still print a zero byte
+	checkLevels(t, "+++[-].>.", "", "\x00\x00")
+	checkLevels(t, "+++>[-]<[>+<-]>.", "", "\x03")
+	checkLevels(t, "+++,.", "a", "a")
+}
+
+func TestFold(t *testing.T) {
+	defer resetFlags()
+	type test struct {
+		code         string
+		instructions []Instruction
+	}
+	var tests []test
+	var commands = []struct {
+		char        string
+		instruction Instruction
+	}{
+		{"+", Instruction{ADD_SUB, 1, 0}},
+		{"-", Instruction{ADD_SUB, -1, 0}},
+		{">", Instruction{PTR_MOV, 1, 0}},
+		{"<", Instruction{PTR_MOV, -1, 0}},
+		{".", Instruction{PUT_CHR, 1, 0}},
+	}
+	// Runs of 1 to 5 on their own, at the start, in the middle and at the very
+	// end of the code. Prints separate them, and input separates prints.
+	for _, command := range commands {
+		var separator, other = ".", Instruction{PUT_CHR, 1, 0}
+		if command.char == "." {
+			separator, other = ",", Instruction{RAD_CHR, 0, 0}
+		}
+		for n := 1; n <= 5; n++ {
+			var run = command.instruction
+			run.Data *= n
+			var code = strings.Repeat(command.char, n)
+			tests = append(tests,
+				test{code, []Instruction{run}},
+				test{code + separator, []Instruction{run, other}},
+				test{separator + code + separator, []Instruction{other, run, other}},
+				test{separator + code, []Instruction{other, run}},
+			)
+		}
+	}
+	// Mixed runs add up, also across comments
+	tests = append(tests,
+		test{"+-+", []Instruction{{ADD_SUB, 1, 0}}},
+		test{"+++--", []Instruction{{ADD_SUB, 1, 0}}},
+		test{"--+-", []Instruction{{ADD_SUB, -2, 0}}},
+		test{"++--", []Instruction{}},
+		test{"+ + a +", []Instruction{{ADD_SUB, 3, 0}}},
+		test{"><<", []Instruction{{PTR_MOV, -1, 0}}},
+		test{">>+<<<", []Instruction{{PTR_MOV, 2, 0}, {ADD_SUB, 1, 0}, {PTR_MOV, -3, 0}}},
+	)
+
+	for _, regex := range []bool{false, true} {
+		regexOptimizer = regex
+		for _, opts := range []Options{unoptimized, {OptPasses: 2, Level: 2}} {
+			for _, test := range tests {
+				var program, err = Compile(test.code, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(program.Instructions, test.instructions) {
+					t.Errorf("regexopt %t, O%d: %q compiled to %v, want %v", regex, opts.Level, test.code, program.Instructions, test.instructions)
+				}
+			}
+		}
+	}
+}
+
+// TestPeephole compiles programs at -O2, where the peephole pass merges the
+// instructions the optimizer leaves next to each other
+func TestPeephole(t *testing.T) {
+	defer resetFlags()
+	auxSize = 4
+	updateDummyChars()
+	var tests = []struct {
+		code         string
+		instructions []Instruction
+	}{
+		// Additions after a clear become a set
+		{"[-]+++", []Instruction{{SET_VAL, 3, 0}}},
+		{"[-]-", []Instruction{{SET_VAL, 255, 0}}},
+		{"[-]++.", []Instruction{{SET_VAL, 2, 0}, {PUT_CHR, 1, 0}}},
+		{">[-]+<", []Instruction{{PTR_MOV, 1, 0}, {SET_VAL, 1, 0}, {PTR_MOV, -1, 0}}},
+		// A clear after a clear or a set is a clear
+		{"[-][+]", []Instruction{{CLR, 0, 0}}},
+		// Skipping a copy loop lands after its clear, so the clear and the
+		// addition after it stay apart
+		{"[->+<]+", []Instruction{{SKP_ZER, 2, 0}, {MUL_CPY, 1, 1}, {CLR, 0, 0}, {ADD_SUB, 1, 0}}},
+		// Moves around aux moves cancel out, or join into one move
+		{">}<", []Instruction{{AUX_MOV, 1, 0}}},
+		{">>}{<+", []Instruction{{PTR_MOV, 1, 0}, {AUX_MOV, 1, 0}, {AUX_MOV, -1, 0}, {ADD_SUB, 1, 0}}},
+		{">>}<", []Instruction{{PTR_MOV, 1, 0}, {AUX_MOV, 1, 0}}},
+		// ^ stores the cell under the pointer on the aux tape, so the moves
+		// around it must stay
+		{">}^<", []Instruction{{PTR_MOV, 1, 0}, {AUX_MOV, 1, 0}, {AUX_STR, 0, 0}, {PTR_MOV, -1, 0}}},
+		{">}.<", []Instruction{{PTR_MOV, 1, 0}, {AUX_MOV, 1, 0}, {PUT_CHR, 1, 0}, {PTR_MOV, -1, 0}}},
+		// The loop jumps back to the aux move, so the move before the loop
+		// can't join the one after the aux move
+		{">+[}<]", []Instruction{{PTR_MOV, 1, 0}, {ADD_SUB, 1, 0}, {JMP_ZER, 5, 0}, {AUX_MOV, 1, 0}, {PTR_MOV, -1, 0}, {JMP_NOT_ZER, 2, 0}}},
+	}
+	for _, regex := range []bool{false, true} {
+		regexOptimizer = regex
+		for _, test := range tests {
+			var program, err = Compile(test.code, Options{OptPasses: 2, Level: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(program.Instructions, test.instructions) {
+				t.Errorf("regexopt %t: %q compiled to %v, want %v", regex, test.code, program.Instructions, test.instructions)
+			}
+		}
+	}
+}
+
+// TestSpacedRuns compiles testprogs/spaced.b, whose runs of commands are split
+// by spaces and comments, to as many instructions as without them
+func TestSpacedRuns(t *testing.T) {
+	defer resetFlags()
+	var code, err = os.ReadFile("testprogs/spaced.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, regex := range []bool{false, true} {
+		regexOptimizer = regex
+		var spaced, err = Compile(string(code), Options{OptPasses: 2, Level: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var packed, _ = Compile("++++++++[>++++++++<-]>+.", Options{OptPasses: 2, Level: 2})
+		if len(spaced.Instructions) != 7 || !reflect.DeepEqual(spaced.Instructions, packed.Instructions) {
+			t.Errorf("regexopt %t: compiled to %v, want the 7 instructions %v", regex, spaced.Instructions, packed.Instructions)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/mitchellh/colorstring"
+)
+
+var replCommands = []string{"help", "clear", "zero", "home", "viewmem", "debug", "stats", "opt", "prompt", "undo", "dump", "explain"}
+
+// undoDepth is how many executed lines undo can take back
+const undoDepth = 10
+
+// replSnapshot is the state of the REPL before a line was executed. Tapes are
+// kept up to their last non-zero cell, so a snapshot costs as much memory as
+// the part of the tape and of each bank that is in use.
+type replSnapshot struct {
+	cells      []uint32
+	cellptr    int
+	auxCells   []uint32
+	auxCellptr int
+	banks      [][]uint32 // Banks after bank 0, nil if they haven't been set up since they were reset
+	activeBank int
+}
+
+// saveTape copies cells up to the last cell that isn't zero
+func saveTape(cells []uint32) []uint32 {
+	var end = knownExtent(cells) + 1
+	for end > 0 && cells[end-1] == 0 {
+		end--
+	}
+	return append([]uint32(nil), cells[:end]...)
+}
+
+// restoreTape returns a tape like the one saveTape copied
+func restoreTape(saved []uint32) []uint32 {
+	var cells = make([]uint32, memorySize)
+	copy(cells, saved)
+	return cells
+}
+
+// parseCommand splits a REPL line into a command and its arguments. ok is false
+// when the first word of the line isn't a known command, in which case the
+// whole line should be executed as Brainfuck.
+func parseCommand(line string) (command string, args string, ok bool) {
+	line = strings.TrimSpace(line)
+	command = line
+	if end := strings.IndexFunc(line, unicode.IsSpace); end != -1 {
+		command = line[:end]
+		args = strings.TrimSpace(line[end:])
+	}
+
+	for _, known := range replCommands {
+		if command == known {
+			return command, args, true
+		}
+	}
+	return "", "", false
+}
+
+// completeCommand completes the command name a REPL line starts with. Only
+// the first word is completed, since whatever follows it is Brainfuck or a
+// command argument. It returns the line extended as far as the commands
+// starting with it agree, with a space after a command that is complete, and
+// those commands if there is more than one.
+func completeCommand(line string) (completed string, candidates []string) {
+	if strings.IndexFunc(line, unicode.IsSpace) != -1 {
+		return line, nil
+	}
+	for _, known := range replCommands {
+		if strings.HasPrefix(known, line) {
+			candidates = append(candidates, known)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return line, nil
+	case 1:
+		return candidates[0] + " ", nil
+	}
+
+	completed = candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, completed) {
+			completed = completed[:len(completed)-1]
+		}
+	}
+	return completed, candidates
+}
+
+// parseToggle interprets an on/off command argument
+func parseToggle(args string) (value bool, ok bool) {
+	switch args {
+	case "on":
+		return true, true
+	case "off":
+		return false, true
+	}
+	return false, false
+}
+
+func printReplHelp() {
+	fmt.Fprintln(diagnostics, "List of available commands:")
+	colorstring.Fprintln(diagnostics, "[blue]help[default] - print this")
+	colorstring.Fprintln(diagnostics, "[blue]clear[default] - reset memory cells to the -fill value and -tape file and move the pointer to cell 0")
+	colorstring.Fprintln(diagnostics, "[blue]zero[default] - reset memory cells to the -fill value and -tape file but keep the pointer")
+	colorstring.Fprintln(diagnostics, "[blue]home[default] - move the pointer to cell 0 but keep memory cells")
+	colorstring.Fprintln(diagnostics, "[blue]viewmem[default] - displays values of memory cells, cell highlighted in [green]green[default] is the cell currently pointed to")
+	colorstring.Fprintln(diagnostics, "[blue]dump sparse[default] - displays only the non-zero memory cells as index: value pairs")
+	colorstring.Fprintln(diagnostics, "[blue]debug <program>[default] - step through a program one instruction at a time")
+	colorstring.Fprintln(diagnostics, "[blue]explain <program>[default] - show what the optimizer makes of a program step by step and the instructions it compiles to")
+	colorstring.Fprintln(diagnostics, "[blue]stats on|off[default] - turn statistics after each execution on or off")
+	colorstring.Fprintln(diagnostics, "[blue]opt on|off[default] - turn the optimizer on or off")
+	colorstring.Fprintln(diagnostics, "[blue]prompt on|off[default] - show the pointer and the value under it in the prompt")
+	colorstring.Fprintln(diagnostics, "[blue]undo[default] - restore memory, the banks and the pointer to before the last executed line or debug session")
+	fmt.Fprintln(diagnostics, "Any other input is executed as Brainfuck. On a terminal, Tab completes command names.")
+}
+
+func repl() {
+	var cellptr = tapeOrigin()
+	var cells = newTape()
+	auxCells = make([]uint32, auxSize)
+	resetBanks()
+
+	// Most recent last
+	var snapshots = make([]replSnapshot, 0, undoDepth)
+	var snapshot = func() {
+		if len(snapshots) == undoDepth {
+			snapshots = snapshots[1:]
+		}
+		var saved = replSnapshot{
+			cells: saveTape(cells), cellptr: cellptr,
+			auxCells: append([]uint32(nil), auxCells...), auxCellptr: auxCellptr,
+			activeBank: activeBank,
+		}
+		// Bank 0 is cells
+		for i := 1; i < len(banks); i++ {
+			saved.banks = append(saved.banks, saveTape(banks[i]))
+		}
+		snapshots = append(snapshots, saved)
+	}
+	var restore = func(saved replSnapshot) {
+		cells, cellptr = restoreTape(saved.cells), saved.cellptr
+		setExtent(cells, len(saved.cells)-1)
+		auxCells, auxCellptr = saved.auxCells, saved.auxCellptr
+		resetBanks()
+		if saved.banks != nil {
+			banks = [][]uint32{cells}
+			for _, bank := range saved.banks {
+				banks = append(banks, restoreTape(bank))
+			}
+			activeBank = saved.activeBank
+		}
+	}
+
+	// Pass count restored by opt on
+	var enabledPasses = optPasses
+	if enabledPasses == 0 {
+		enabledPasses = 2
+	}
+
+	fmt.Fprintln(diagnostics, `   _____  ____   ____  ______ `)
+	fmt.Fprintln(diagnostics, `  / ____|/ __ \ / __ \|  ____|`)
+	fmt.Fprintln(diagnostics, ` | |  __| |  | | |  | | |__   `)
+	fmt.Fprintln(diagnostics, ` | | |_ | |  | | |  | |  __|  `)
+	fmt.Fprintln(diagnostics, ` | |__| | |__| | |__| | |     `)
+	fmt.Fprintln(diagnostics, `  \_____|\____/ \____/|_|     `)
+	fmt.Fprintln(diagnostics)
+	fmt.Fprintln(diagnostics, "Goof - an optimizing bf VM written in Go")
+	fmt.Fprintln(diagnostics, "Version "+Version+" (REPL mode)")
+	fmt.Fprintln(diagnostics, "Collect statistics: ", trackStatistics)
+	fmt.Fprintln(diagnostics, "Optimization passes: ", optPasses)
+	fmt.Fprintln(diagnostics, "Memory cells available: ", memorySize)
+	colorstring.Fprintln(diagnostics, "Type [blue]help[default] to see available commands.")
+	if memorySize <= 64 { // Probably useless but whatever
+		colorstring.Fprintln(diagnostics, "[yellow]WARNING:[default] Memory might be too small!")
+	}
+
+	for true {
+		var prompt = ">>> "
+		if cellPrompt {
+			prompt = fmt.Sprintf("[p=%d v=%d] >>> ", cellptr-tapeOrigin(), cellValue(cells[cellptr]))
+		}
+		fmt.Fprint(diagnostics, prompt)
+		var line, err = readLine(prompt)
+		if err != nil && line == "" {
+			// End of input, e.g. Ctrl-D
+			fmt.Fprintln(diagnostics)
+			return
+		}
+		line = strings.TrimSpace(line)
+
+		if semicolonComments {
+			line = strings.TrimSpace(stripComments(line))
+		}
+
+		var command, args, ok = parseCommand(line)
+		if !ok {
+			if line == "" {
+				continue
+			}
+			snapshot()
+			err = RunOn(cells, &cellptr, line, Options{OptPasses: optPasses, Level: optLevel, Size: sizeOptimization})
+			var breakpoint *breakpointError
+			if errors.As(err, &breakpoint) {
+				parseMessage(line, err.Error(), Info)
+				dumpMem(&cells, &cellptr)
+				err = debugMachine(breakpoint.vm)
+			}
+			if err != nil {
+				parseMessage(line, err.Error(), Error)
+			}
+			continue
+		}
+
+		switch command {
+		case "help":
+			printReplHelp()
+		case "clear":
+			cellptr = tapeOrigin()
+			cells = newTape()
+			resetBanks()
+		case "zero":
+			cells = newTape()
+			resetBanks()
+		case "home":
+			cellptr = tapeOrigin()
+		case "viewmem":
+			dumpMem(&cells, &cellptr)
+		case "dump":
+			if args == "sparse" {
+				dumpSparse(&cells, &cellptr)
+			} else {
+				dumpMem(&cells, &cellptr)
+			}
+		case "debug":
+			snapshot()
+			if err := debug(&cells, &cellptr, &args); err != nil {
+				parseMessage(args, err.Error(), Error)
+			}
+		case "explain":
+			explain(args, enabledPasses)
+		case "stats":
+			if value, ok := parseToggle(args); ok {
+				trackStatistics = value
+			} else if args != "" {
+				parseMessage(args, "Expected stats on or stats off", Warning)
+			}
+			fmt.Fprintln(diagnostics, "Collect statistics: ", trackStatistics)
+		case "opt":
+			if value, ok := parseToggle(args); ok && value {
+				optPasses = enabledPasses
+			} else if ok {
+				optPasses = 0
+			} else if args != "" {
+				parseMessage(args, "Expected opt on or opt off", Warning)
+			}
+			fmt.Fprintln(diagnostics, "Optimization passes: ", optPasses)
+		case "undo":
+			if len(snapshots) == 0 {
+				parseMessage("", "Nothing to undo", Warning)
+				continue
+			}
+			restore(snapshots[len(snapshots)-1])
+			snapshots = snapshots[:len(snapshots)-1]
+		case "prompt":
+			if value, ok := parseToggle(args); ok {
+				cellPrompt = value
+			} else {
+				parseMessage(args, "Expected prompt on or prompt off", Warning)
+			}
+		}
+	}
+}
+
+// explain shows what the optimizer makes of code step by step, running as many
+// passes as opt on would: with -regexopt the code after each of its steps,
+// otherwise the code after the token optimizer rewrites each loop, then its
+// result. It then lists the instructions code compiles to at the current -O
+// level, after the peephole pass.
+func explain(code string, passes int) {
+	if code == "" {
+		parseMessage("", "Expected a program to explain", Warning)
+		return
+	}
+	if regexOptimizer {
+		optimizeStages(code, passes, func(label string, code string) {
+			colorstring.Fprintf(diagnostics, "[blue]%s:[default] %s\n", label, code)
+		})
+	} else {
+		var optimized, _, _ = optimizeTokenStages(code, passes, func(label string, code string) {
+			colorstring.Fprintf(diagnostics, "[blue]%s:[default] %s\n", label, code)
+		})
+		colorstring.Fprintf(diagnostics, "[blue]Optimized:[default] %s\n", optimized)
+	}
+	fmt.Fprintln(diagnostics, "C clears a cell, R and L scan right and left, each P is one target of a copy loop")
+
+	var level = fmt.Sprintf("-O%d", optLevel)
+	if sizeOptimization {
+		level = "-Os"
+	}
+	var program, err = Compile(code, Options{OptPasses: passes, Level: optLevel, Size: sizeOptimization})
+	if err != nil {
+		parseMessage(code, err.Error(), Error)
+		return
+	}
+	colorstring.Fprintf(diagnostics, "[blue]Compiled at %s:[default]\n", level)
+	for pc, instruction := range program.Instructions {
+		fmt.Fprintf(diagnostics, "%6d %-11s %5d %5d\n", pc, instructionNames[instruction.Type], instruction.Data, instruction.AuxData)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runRepl feeds lines to the REPL and returns what it printed to diagnostics
+// and as program output, failing if it doesn't return at the end of input
+func runRepl(t *testing.T, lines string) (string, string) {
+	t.Helper()
+	var messages, printed bytes.Buffer
+	var savedInput, savedOutput = input, output
+	input = bufio.NewReader(strings.NewReader(lines))
+	output = bufio.NewWriter(&printed)
+	diagnostics = &messages
+	defer func() {
+		input, output = savedInput, savedOutput
+		resetFlags()
+	}()
+
+	var done = make(chan struct{})
+	go func() {
+		repl()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the REPL didn't return at the end of input")
+	}
+	output.Flush()
+	return messages.String(), printed.String()
+}
+
+func TestReplEndOfInput(t *testing.T) {
+	runRepl(t, "")
+	// A last line without a newline still runs
+	if _, printed := runRepl(t, "++++++++[>++++++++<-]>+.\n+."); printed != "AB" {
+		t.Errorf("got %q, want \"AB\"", printed)
+	}
+}
+
+func TestReplUndo(t *testing.T) {
+	var tests = []struct {
+		name  string
+		banks int
+		lines string
+		want  string
+	}{
+		{"tape", 1, "+++\n>++\nundo\n.>.\n", "\x03\x00"},
+		{"pointer", 1, "+\n>>\nundo\n.\n", "\x01"},
+		{"several lines", 1, "+\n+\n+\nundo\nundo\n.\n", "\x01"},
+		{"banks", 2, "+++@++\n@+@\nundo\n.@.\n", "\x03\x02"},
+		{"banks set up by the undone line", 2, "+\n@+\nundo\n@.\n", "\x00"},
+	}
+	for _, test := range tests {
+		bankCount = test.banks
+		updateDummyChars()
+		if _, printed := runRepl(t, test.lines); printed != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, printed, test.want)
+		}
+	}
+}
+
+func TestReplDumpSparse(t *testing.T) {
+	var code, err = os.ReadFile("testprogs/sparse.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var program = string(code[bytes.LastIndexByte(bytes.TrimSpace(code), '\n')+1:])
+	var messages, _ = runRepl(t, "dump sparse\n"+program+"dump sparse\n")
+	var dump = messages[strings.Index(messages, "All cells are zero\n"):]
+	// The cell under the pointer is highlighted
+	for _, line := range []string{">>> 0: 1\n", "\n12: \x1b[32m2\x1b[", "25: 3\n"} {
+		if !strings.Contains(dump, line) {
+			t.Errorf("got %q, want a line %q", dump, line)
+		}
+	}
+	if strings.Contains(dump, ": 0") {
+		t.Errorf("got %q, which has zero cells", dump)
+	}
+}
+
+func TestReplPrompt(t *testing.T) {
+	cellPrompt, biasTape, memorySize = true, true, 100
+	defer func() { cellPrompt = false }()
+	var messages, _ = runRepl(t, "<<+++\n")
+	if !strings.Contains(messages, "[p=0 v=0] >>> ") || !strings.Contains(messages, "[p=-2 v=3] >>> ") {
+		t.Errorf("got %q, want prompts with the pointer on 0 and then -2", messages)
+	}
+}
+
+func TestReplExplain(t *testing.T) {
+	var tests = []struct {
+		name     string
+		regex    bool
+		size     bool
+		contains []string
+		omits    []string
+	}{
+		{"token optimizer", false, false, []string{"Strip comments:\x1b[39m +++[->+<]>.", "Copy loop:\x1b[39m +++P>.", "Optimized:\x1b[39m +++P>.", "Compiled at -O2:", "SKP_ZER", "MUL_CPY"}, []string{"Copy loops"}},
+		{"regex optimizer", true, false, []string{"Strip comments:\x1b[39m +++[->+<]>.", "Copy loops (pass 2):\x1b[39m +++P>.", "Compiled at -O2:"}, []string{"Optimized:"}},
+		{"size", false, true, []string{"Compiled at -Os:", "MUL_CPY"}, []string{"SKP_ZER"}},
+	}
+	for _, test := range tests {
+		regexOptimizer, sizeOptimization = test.regex, test.size
+		var messages, _ = runRepl(t, "explain +++[->+<]>.\n")
+		for _, text := range test.contains {
+			if !strings.Contains(messages, text) {
+				t.Errorf("%s: %q doesn't contain %q", test.name, messages, text)
+			}
+		}
+		for _, text := range test.omits {
+			if strings.Contains(messages, text) {
+				t.Errorf("%s: %q contains %q", test.name, messages, text)
+			}
+		}
+	}
+
+	// The token optimizer shows the code after each loop it rewrites, in order
+	regexOptimizer, sizeOptimization = false, false
+	var messages, _ = runRepl(t, "explain [-]>[>]<[->+<]\n")
+	var steps = []string{"Clear loop:\x1b[39m C>[>]<[->+<]", "Scan loop:\x1b[39m C>R<[->+<]", "Copy loop:\x1b[39m C>R<P", "Optimized:\x1b[39m C>R<P"}
+	for i := 1; i < len(steps); i++ {
+		var before, after = strings.Index(messages, steps[i-1]), strings.Index(messages, steps[i])
+		if before == -1 || after < before {
+			t.Errorf("%q doesn't contain %q followed by %q", messages, steps[i-1], steps[i])
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	var tests = []struct {
+		line    string
+		command string
+		args    string
+		ok      bool
+	}{
+		{"help", "help", "", true},
+		{"dump sparse", "dump", "sparse", true},
+		{"explain +[->+<]", "explain", "+[->+<]", true},
+		// Whitespace around the command and its arguments is dropped
+		{"  help \n", "help", "", true},
+		{"dump \t sparse  \r\n", "dump", "sparse", true},
+		{"opt\ton", "opt", "on", true},
+		{" \n", "", "", false},
+		{"unknown", "", "", false},
+		// Brainfuck that starts like a command runs as Brainfuck
+		{"helper+", "", "", false},
+		{"clear+++", "", "", false},
+		{"+++", "", "", false},
+	}
+	for _, test := range tests {
+		var command, args, ok = parseCommand(test.line)
+		if command != test.command || args != test.args || ok != test.ok {
+			t.Errorf("%q: got %q, %q, %t, want %q, %q, %t", test.line, command, args, ok, test.command, test.args, test.ok)
+		}
+	}
+}
+
+func TestCompleteCommand(t *testing.T) {
+	var tests = []struct {
+		line       string
+		completed  string
+		candidates []string
+	}{
+		{"he", "help ", nil},
+		{"explain", "explain ", nil},
+		{"d", "d", []string{"debug", "dump"}},
+		{"st", "stats ", nil},
+		{"xyz", "xyz", nil},
+		// Only the command itself is completed
+		{"dump sp", "dump sp", nil},
+		{"+[he", "+[he", nil},
+	}
+	for _, test := range tests {
+		var completed, candidates = completeCommand(test.line)
+		if completed != test.completed || !reflect.DeepEqual(candidates, test.candidates) {
+			t.Errorf("%q: got %q, %q, want %q, %q", test.line, completed, candidates, test.completed, test.candidates)
+		}
+	}
+}
+
+func TestEditLine(t *testing.T) {
+	var tests = []struct {
+		keys string
+		line string
+		err  error
+	}{
+		{"ex\t+.\r", "explain +.\n", nil},
+		{"+++x\x7f.\r", "+++.\n", nil},
+		{"d\tu\t\r", "dump \n", nil},
+		{"+\x1b[A-\r", "+-\n", nil},
+		{"\x04", "", io.EOF},
+		{"+\x03", "", errLineInterrupted},
+	}
+	for _, test := range tests {
+		var echo bytes.Buffer
+		var line, err = editLine(bufio.NewReader(strings.NewReader(test.keys)), &echo, ">>> ")
+		if line != test.line || err != test.err {
+			t.Errorf("%q: got %q, %v, want %q, %v", test.keys, line, err, test.line, test.err)
+		}
+	}
+
+	// Tab lists the commands when there's more than one, then shows the line again
+	var echo bytes.Buffer
+	editLine(bufio.NewReader(strings.NewReader("d\t\r")), &echo, ">>> ")
+	if want := "d\ndebug  dump\n>>> d\n"; echo.String() != want {
+		t.Errorf("echoed %q, want %q", echo.String(), want)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/colorstring"
+)
+
+// Set by -selftest
+var selfTest bool
+
+// selfTestCase is a program bundled into the binary with the output it must
+// print for the given input
+type selfTestCase struct {
+	name   string
+	code   string
+	input  string
+	output string
+}
+
+var selfTestCases = []selfTestCase{
+	{"hello", "++++++++[>++++[>++>+++>+++>+<<<<-]>+>+>->>+[<]<-]>>.>---.+++++++..+++.>>.<-.<.+++.------.--------.>>+.>++.", "", "Hello World!\n"},
+	{"cat", ",[.,]", "goof\n", "goof\n"},
+	{"add", "++>+++[<+>-]++++++++[<++++++>-]<.", "", "5"},
+	{"multiply", "++++++[>+++++++<-]>.", "", "*"},
+	{"copy and scan", "++++++++[>++++++++++++>++++++++++++>++++++++++++<<<-]>+>++>+++[<]>[.>]", "", "abc"},
+	{"nested", "++++[>++++[>++++<-]<-]>>+.[-]<,.", "x", "Ax"},
+}
+
+// runSelfTest runs a self-test on a fresh tape, returning what it printed
+func runSelfTest(test selfTestCase, opts Options) ([]byte, error) {
+	var cells = make([]uint32, memorySize)
+	var cellptr = tapeOrigin()
+	resetBanks()
+
+	var err error
+	var printed = captureRun(strings.NewReader(test.input), func() {
+		err = RunOn(cells, &cellptr, test.code, opts)
+	})
+	return printed, err
+}
+
+// defaultOutputFlags sets the flags that change what programs print, or how
+// their cells wrap, to their defaults, since the expected output of the
+// self-tests assumes them. It returns a function that restores them.
+func defaultOutputFlags() (restore func()) {
+	var decimal, utf8, table, signed = decimalOutput, utf8Output, outputTable, signedCells
+	var warn, fail, echo = asciiWarn, asciiError, echoInput
+	var size, mask, limit = cellSize, cellMask, maxCell
+	decimalOutput, utf8Output, outputTable, signedCells = false, false, nil, false
+	asciiWarn, asciiError, echoInput = false, false, false
+	cellSize, cellMask, maxCell = 8, 0xFF, 0
+	return func() {
+		decimalOutput, utf8Output, outputTable, signedCells = decimal, utf8, table, signed
+		asciiWarn, asciiError, echoInput = warn, fail, echo
+		cellSize, cellMask, maxCell = size, mask, limit
+	}
+}
+
+// selfTestAll runs every self-test with the optimizer off and with the
+// optimization flags given, reporting each result, and fails if any of them
+// printed something else than expected. Output flags are ignored.
+func selfTestAll() error {
+	defer defaultOutputFlags()()
+
+	var configurations = []struct {
+		name string
+		opts Options
+	}{
+		{"unoptimized", Options{OptPasses: 0, Level: 0}},
+		{"optimized", Options{OptPasses: optPasses, Level: optLevel, Size: sizeOptimization}},
+	}
+
+	var failed = 0
+	var total = 0
+	for _, test := range selfTestCases {
+		for _, configuration := range configurations {
+			total++
+			var printed, err = runSelfTest(test, configuration.opts)
+			switch {
+			case err != nil:
+				failed++
+				colorstring.Fprintf(diagnostics, "[red]FAIL[default] %s (%s): %s\n", test.name, configuration.name, err)
+			case string(printed) != test.output:
+				failed++
+				colorstring.Fprintf(diagnostics, "[red]FAIL[default] %s (%s): expected %q, got %q\n", test.name, configuration.name, test.output, printed)
+			default:
+				colorstring.Fprintf(diagnostics, "[green]PASS[default] %s (%s)\n", test.name, configuration.name)
+			}
+		}
+	}
+
+	fmt.Fprintf(diagnostics, "%d of %d self-tests passed\n", total-failed, total)
+	if failed > 0 {
+		return newError(ExitSelfTest, "%d self-tests failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// makeRaw is only implemented on Linux, elsewhere the REPL reads whole lines
+// without completion
+func makeRaw(file *os.File) (restore func(), ok bool) {
+	return nil, false
+}
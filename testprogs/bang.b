@@ -0,0 +1,3 @@
+Copies everything after the bang to the output
+Run it with the bang flag
+,[.,]!Hello from the input
@@ -0,0 +1,8 @@
+Keeps a different letter in the same cell of two tape banks and prints
+them in turn
+Run it with the banks flag set to 2 and it prints ABAB
+
+++++++++[>++++++++<-]>+
+@
+<++++++++[>++++++++<-]>++
+@.@.@.@.
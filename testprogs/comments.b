@@ -0,0 +1,5 @@
+; Prints "Hi" with comments that would break loop matching without -comments
+; [ a stray open bracket
+++++++++[>+++++++++<-]>.  ; 72 is H [and another one
+; ] plus a close bracket that matches nothing
++++++++++++++++++++++++++++++++++.  ; 105 is i
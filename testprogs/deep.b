@@ -0,0 +1,19 @@
+Prints an exclamation mark from inside loops nested eight deep
+Run it with maxdepth set below eight to see it rejected
+
++
+[>+
+ [>+
+  [>+
+   [>+
+    [>+
+     [>+
+      [>+
+       [>+++++[<++++++>-]<++.[-]]
+      <-]
+     <-]
+    <-]
+   <-]
+  <-]
+ <-]
+<-]
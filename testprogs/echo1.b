@@ -0,0 +1,4 @@
+Echoes one character followed by a newline
+Compiling it with the emit flag set to wat gives echo1 dot wat next to it
+
+,.[-]++++++++++.
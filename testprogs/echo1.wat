@@ -0,0 +1,21 @@
+(module
+  (import "env" "putchar" (func $putchar (param i32)))
+  (import "env" "getchar" (func $getchar (result i32)))
+  (memory (export "memory") 2)
+  (func (export "run") (local $p i32) (local $t i32)
+    local.get $p
+    call $getchar
+    i32.const 255
+    i32.and
+    i32.store
+    local.get $p
+    i32.load
+    call $putchar
+    local.get $p
+    i32.const 10
+    i32.store
+    local.get $p
+    i32.load
+    call $putchar
+  )
+)
@@ -0,0 +1,6 @@
+Prints one line of input with an arrow in front of it
+Run it with the filter flag to handle every line of its input
+Each line has to end with a newline
+
+++++++++[>++++>++++++++<<-]>>--.<.[-]>[-]<<
+,----------[++++++++++.,----------]++++++++++.[-]
@@ -0,0 +1,6 @@
+Walks left of where it starts and writes 1 2 3 into the three cells there
+nearest first then prints them as digits from left to right which gives 321
+Run it with the biastape flag as it would move off the tape otherwise
+
+<+<++<+++
+[++++++++++++++++++++++++++++++++++++++++++++++++.>]
@@ -0,0 +1,14 @@
+Loops wrapping a clear must not be collapsed into something else
+Prints ABC when they are compiled correctly
+
+Wrapped clear: the outer loop runs once
++++++[[-]]
++++++++++++++[>+++++<-]>.[-]<
+
+Clear followed by a move inside the outer loop: adds one to the next cell once
++++[[-]>+<]
+>+++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++.[-]<
+
+Decrement before the inner clear
+++++[-[-]]
++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++.
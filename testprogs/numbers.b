@@ -0,0 +1,3 @@
+Prints the numbers 1 to 10 and then 100 twice
+Run it with the numout flag to see them as decimal numbers
+++++++++++[>+.<-]>[-]++++++++++[>++++++++++<-]>..
@@ -0,0 +1,7 @@
+Clears a cell and prints it then reads a byte into a cell it just changed
+then prints that byte
+Unoptimized or with the no optimize io flag it prints a zero byte and then
+its input while the optimizer drops the zero byte
+
++++[-].
++++,.
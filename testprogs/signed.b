@@ -0,0 +1,10 @@
+Prints one cell wrapped below zero then one at the top of the signed range
+then one just past it
+Run it with the numout and signed flags and the output is
+  minus 1 then 127 then minus 128
+Without signed it is 255 then 127 then 128 and with 16 bit cells and signed
+it is minus 1 then 127 then 128
+
+-.
+>++++++++[<++++++++++++++++>-]<.
++.
@@ -0,0 +1,8 @@
+Prints A with every command separated by spaces or comments
+Runs of the same command still fold into one instruction each
+so the count flag reports the same 7 instructions as without the spacing
+
++ + + + + + + +   eight
+[ > + + + + + + + + < - ]   times eight
+>   over to the result
++ .   plus one and print
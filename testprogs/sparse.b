@@ -0,0 +1,8 @@
+Leaves three cells far apart set to 1 and 2 and 3 with the pointer on the middle one
+Run it with the dm and dm nonzero only flags to see just those cells
+Expected dump
+  0: 1
+  12: 2 (highlighted)
+  25: 3
+
++>>>>>>>>>>>>++>>>>>>>>>>>>>+++<<<<<<<<<<<<<
@@ -0,0 +1,3 @@
+; Prints A but fails to compile under the strict flag because of the stray letter
+; Run it with the strict and comments flags
+++++++++[>++++++++<-]>+.x
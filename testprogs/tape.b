@@ -0,0 +1,3 @@
+Prints the cells loaded with the tape flag up to the first zero cell
+Run it with the tape flag pointing at the tape txt file next to it
+[.>]
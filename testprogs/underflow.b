@@ -0,0 +1,3 @@
+Moves the pointer below cell 0 before doing anything else
+Goof rejects it before running it unless the pointer wraps
++++<<<.
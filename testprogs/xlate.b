@@ -0,0 +1,4 @@
+Copies its input to its output like cat dot b
+The test runs it with the rot13 dot xlate table so what it prints is ROT13
+
+,[.,]
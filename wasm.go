@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// wasmOp is one WebAssembly instruction in both its text and binary form
+type wasmOp struct {
+	text   string
+	binary []byte
+}
+
+// wasmFunction collects the body of the exported run function. The pointer
+// is kept in local 0 as a byte address, local 1 holds copy targets.
+type wasmFunction struct {
+	ops   []wasmOp
+	depth []int // Nesting depth before each op, for indenting the text form
+	level int
+	err   error
+}
+
+func (f *wasmFunction) op(text string, binary ...byte) {
+	if strings.HasPrefix(text, "end") {
+		f.level--
+	}
+	f.ops = append(f.ops, wasmOp{text, binary})
+	f.depth = append(f.depth, f.level)
+	if text == "block" || text == "loop" || text == "if" {
+		f.level++
+	}
+}
+
+// uleb128 and sleb128 encode integers the way WebAssembly immediates are
+func uleb128(value uint32) []byte {
+	var encoded = make([]byte, 0, 5)
+	for {
+		var b = byte(value & 0x7F)
+		value >>= 7
+		if value == 0 {
+			return append(encoded, b)
+		}
+		encoded = append(encoded, b|0x80)
+	}
+}
+
+func sleb128(value int32) []byte {
+	var encoded = make([]byte, 0, 5)
+	for {
+		var b = byte(value & 0x7F)
+		value >>= 7
+		if value == 0 && b&0x40 == 0 || value == -1 && b&0x40 != 0 {
+			return append(encoded, b)
+		}
+		encoded = append(encoded, b|0x80)
+	}
+}
+
+func (f *wasmFunction) constant(value int32) {
+	f.op(fmt.Sprintf("i32.const %d", value), append([]byte{0x41}, sleb128(value)...)...)
+}
+
+func (f *wasmFunction) local(instruction string, code byte, index uint32) {
+	var names = [...]string{"$p", "$t"}
+	f.op(instruction+" "+names[index], code, byte(index))
+}
+
+func (f *wasmFunction) branch(instruction string, code byte, depth uint32) {
+	f.op(fmt.Sprintf("%s %d", instruction, depth), append([]byte{code}, uleb128(depth)...)...)
+}
+
+// loadCell pushes the cell the pointer is on
+func (f *wasmFunction) loadCell() {
+	f.local("local.get", 0x20, 0)
+	f.op("i32.load", 0x28, 2, 0)
+}
+
+// mask keeps the value on the stack within the cell size
+func (f *wasmFunction) mask() {
+	if cellMask != 0xFFFFFFFF {
+		f.constant(int32(cellMask))
+		f.op("i32.and", 0x71)
+	}
+}
+
+// offsetPointer leaves the pointer moved by offset cells in the given local,
+// wrapping around the tape or trapping when it leaves it
+func (f *wasmFunction) offsetPointer(offset int, local uint32) {
+	var size = int32(memorySize * 4)
+	f.local("local.get", 0x20, 0)
+	f.constant(int32(offset * 4))
+	f.op("i32.add", 0x6A)
+	if wrapPointer {
+		f.constant(size)
+		f.op("i32.rem_s", 0x6F)
+		f.constant(size)
+		f.op("i32.add", 0x6A)
+		f.constant(size)
+		f.op("i32.rem_s", 0x6F)
+		f.local("local.set", 0x21, local)
+		return
+	}
+	f.local("local.tee", 0x22, local)
+	f.constant(size)
+	f.op("i32.ge_u", 0x4F)
+	f.op("if", 0x04, 0x40)
+	f.op("unreachable", 0x00)
+	f.op("end", 0x0B)
+}
+
+// lower appends the WebAssembly for instructions to the function
+func (f *wasmFunction) lower(instructions []Instruction) {
+	// Number of blocks to close after each instruction, for SKP_ZER
+	var closing = make([]int, len(instructions))
+	for pc, instruction := range instructions {
+		switch instruction.Type {
+		case ADD_SUB:
+			f.local("local.get", 0x20, 0)
+			f.loadCell()
+			f.constant(int32(instruction.Data))
+			f.op("i32.add", 0x6A)
+			f.mask()
+			f.op("i32.store", 0x36, 2, 0)
+		case PTR_MOV:
+			f.offsetPointer(instruction.Data, 0)
+		case JMP_ZER:
+			f.op("block", 0x02, 0x40)
+			f.loadCell()
+			f.op("i32.eqz", 0x45)
+			f.branch("br_if", 0x0D, 0)
+			f.op("loop", 0x03, 0x40)
+		case JMP_NOT_ZER:
+			f.loadCell()
+			f.branch("br_if", 0x0D, 0)
+			f.op("end", 0x0B)
+			f.op("end", 0x0B)
+		case PUT_CHR:
+			for n := 0; n < instruction.Data; n++ {
+				f.loadCell()
+				f.op("call $putchar", 0x10, 0)
+			}
+		case RAD_CHR:
+			f.local("local.get", 0x20, 0)
+			f.op("call $getchar", 0x10, 1)
+			f.mask()
+			f.op("i32.store", 0x36, 2, 0)
+		case CLR, SET_VAL:
+			f.local("local.get", 0x20, 0)
+			f.constant(int32(instruction.Data))
+			f.op("i32.store", 0x36, 2, 0)
+		case SKP_ZER:
+			f.op("block", 0x02, 0x40)
+			f.loadCell()
+			f.op("i32.eqz", 0x45)
+			f.branch("br_if", 0x0D, 0)
+			closing[instruction.Data]++
+		case MUL_CPY:
+			// Copies of zero do nothing, not even leave the tape
+			f.loadCell()
+			f.op("if", 0x04, 0x40)
+			f.offsetPointer(instruction.Data, 1)
+			f.local("local.get", 0x20, 1)
+			f.local("local.get", 0x20, 1)
+			f.op("i32.load", 0x28, 2, 0)
+			f.loadCell()
+			f.constant(int32(instruction.AuxData))
+			f.op("i32.mul", 0x6C)
+			f.op("i32.add", 0x6A)
+			f.mask()
+			f.op("i32.store", 0x36, 2, 0)
+			f.op("end", 0x0B)
+		case SCN_RGT, SCN_LFT:
+			var step = instruction.Data
+			if instruction.Type == SCN_LFT {
+				step = -step
+			}
+			f.op("block", 0x02, 0x40)
+			f.op("loop", 0x03, 0x40)
+			f.loadCell()
+			f.op("i32.eqz", 0x45)
+			f.branch("br_if", 0x0D, 1)
+			f.offsetPointer(step, 0)
+			f.branch("br", 0x0C, 0)
+			f.op("end", 0x0B)
+			f.op("end", 0x0B)
+		default:
+			f.err = newError(ExitSyntax, "%s can't be emitted as WebAssembly (instruction %d)", instructionNames[instruction.Type], pc)
+			return
+		}
+		for ; closing[pc] > 0; closing[pc]-- {
+			f.op("end", 0x0B)
+		}
+	}
+}
+
+// wasmPages is the number of 64 KiB memory pages the tape needs
+func wasmPages() int {
+	return (memorySize*4 + 0xFFFF) / 0x10000
+}
+
+// lowerWasm turns instructions into the body of the run function
+func lowerWasm(instructions []Instruction) (*wasmFunction, error) {
+	if fillValue != 0 || len(tapeData) > 0 {
+		return nil, newError(ExitSyntax, "WebAssembly modules start on a zeroed tape, -fill and -tape can't be used")
+	}
+	var f = &wasmFunction{level: 2}
+	if origin := tapeOrigin(); origin != 0 {
+		f.constant(int32(origin * 4))
+		f.local("local.set", 0x21, 0)
+	}
+	f.lower(instructions)
+	return f, f.err
+}
+
+// emitWat writes instructions as a WebAssembly module in the text format. The
+// module imports putchar and getchar from env, which get and return whole
+// cells, getchar returning 0 at the end of input. It exports its memory, where
+// each cell takes 4 bytes, and a run function that runs the program.
+func emitWat(w io.Writer, instructions []Instruction) error {
+	var f, err = lowerWasm(instructions)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "(module")
+	fmt.Fprintln(w, "  (import \"env\" \"putchar\" (func $putchar (param i32)))")
+	fmt.Fprintln(w, "  (import \"env\" \"getchar\" (func $getchar (result i32)))")
+	fmt.Fprintf(w, "  (memory (export \"memory\") %d)\n", wasmPages())
+	fmt.Fprintln(w, "  (func (export \"run\") (local $p i32) (local $t i32)")
+	for i, op := range f.ops {
+		fmt.Fprintf(w, "%s%s\n", strings.Repeat("  ", f.depth[i]), op.text)
+	}
+	fmt.Fprintln(w, "  )")
+	fmt.Fprintln(w, ")")
+	return nil
+}
+
+// emitWasm writes the module emitWat describes in the binary format
+func emitWasm(w io.Writer, instructions []Instruction) error {
+	var f, err = lowerWasm(instructions)
+	if err != nil {
+		return err
+	}
+
+	var module bytes.Buffer
+	module.Write([]byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00})
+	var section = func(id byte, contents ...byte) {
+		module.WriteByte(id)
+		module.Write(uleb128(uint32(len(contents))))
+		module.Write(contents)
+	}
+	var name = func(s string) []byte {
+		return append(uleb128(uint32(len(s))), s...)
+	}
+	var join = func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	// Types: putchar (i32) -> (), getchar () -> i32, run () -> ()
+	section(1, 0x03, 0x60, 0x01, 0x7F, 0x00, 0x60, 0x00, 0x01, 0x7F, 0x60, 0x00, 0x00)
+	section(2, join([]byte{0x02},
+		name("env"), name("putchar"), []byte{0x00, 0x00},
+		name("env"), name("getchar"), []byte{0x00, 0x01})...)
+	section(3, 0x01, 0x02)
+	section(5, join([]byte{0x01, 0x00}, uleb128(uint32(wasmPages())))...)
+	section(7, join([]byte{0x02},
+		name("memory"), []byte{0x02, 0x00},
+		name("run"), []byte{0x00, 0x02})...)
+
+	// Two i32 locals, the body and the end of the function
+	var body = []byte{0x01, 0x02, 0x7F}
+	for _, op := range f.ops {
+		body = append(body, op.binary...)
+	}
+	body = append(body, 0x0B)
+	section(10, join([]byte{0x01}, uleb128(uint32(len(body))), body)...)
+
+	_, err = w.Write(module.Bytes())
+	return err
+}
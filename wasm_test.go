@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEmitWat(t *testing.T) {
+	emitFormat = "wat"
+	defer resetFlags()
+	var expected, err = os.ReadFile("testprogs/echo1.wat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var module string
+	if module, err = runFileOutput(t, "testprogs/echo1.b", ""); err != nil {
+		t.Fatal(err)
+	}
+	if module != string(expected) {
+		t.Errorf("got\n%s\nwant\n%s", module, expected)
+	}
+}
+
+func TestEmitWasm(t *testing.T) {
+	emitFormat = "wasm"
+	defer resetFlags()
+	var module, err = runFileOutput(t, "testprogs/echo1.b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(module, "\x00asm\x01\x00\x00\x00") {
+		t.Errorf("got %q, want a module starting with the WebAssembly 1 header", module)
+	}
+	for _, name := range []string{"env", "putchar", "getchar", "memory", "run"} {
+		if !strings.Contains(module, name) {
+			t.Errorf("the module doesn't name %s", name)
+		}
+	}
+}